@@ -0,0 +1,219 @@
+package mcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	mp "github.com/vmihailenco/msgpack"
+)
+
+// blobDirPrefix names the directory next to an index's file that holds its blobs, one file per blob named by its hash
+const blobDirPrefix = "mcache-blobs-"
+
+// blobGracePeriod protects recently written blob files from garbage collection, so an upload is not collected before the document referring to it is written
+const blobGracePeriod = time.Hour
+
+// BlobRef refers to a large attachment stored outside the index's documents
+type BlobRef struct {
+	// Hash is the hex-encoded SHA-256 checksum of the blob
+	Hash        string `json:"hash"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+func (i *Index) blobDir() string {
+	return filepath.Join(filepath.Dir(i.path), blobDirPrefix+i.ID)
+}
+
+func (i *Index) blobPath(hash string) string {
+	return filepath.Join(i.blobDir(), hash)
+}
+
+// isBlobHash returns true if `hash` is a hex-encoded SHA-256 checksum, so it is safe to use as a filename
+func isBlobHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil && strings.ToLower(hash) == hash
+}
+
+// PutBlob stores the contents of `r` as the blob of the document with the given ID, creating the document if it does not exist.
+// If `checksum` is set, the blob is only stored if its hex-encoded SHA-256 checksum matches.
+func (i *Index) PutBlob(id string, r io.Reader, contentType string, checksum string) (*Document, error) {
+	if checksum != "" && !isBlobHash(strings.ToLower(checksum)) {
+		return nil, fmt.Errorf("Invalid blob for %v: checksum must be a hex-encoded SHA-256 hash", id)
+	}
+	ref, err := i.writeBlob(r)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != "" && strings.ToLower(checksum) != ref.Hash {
+		return nil, fmt.Errorf("Invalid blob for %v: checksum does not match", id)
+	}
+	ref.ContentType = contentType
+
+	updated, err := i.update(func(tx *storeTx) (*DocSet, error) {
+		d, ok := tx.Get(id)
+		if !ok || d.Deleted || isExpired(d, time.Now().Unix()) {
+			d = Document{ID: id}
+		}
+		d.Blob = &ref
+		return NewDocSet(d), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	doc, err := i.export(updated.Docs[id])
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// writeBlob copies `r` into the index's blob directory, returning a reference to the blob without a content type
+func (i *Index) writeBlob(r io.Reader) (ref BlobRef, err error) {
+	dir := i.blobDir()
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(dir, "upload-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	max := i.config.MaxBlobSize
+	if max > 0 {
+		r = io.LimitReader(r, max+1)
+	}
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	if max > 0 && size > max {
+		return ref, fmt.Errorf("Invalid blob: larger than %v bytes", max)
+	}
+
+	ref = BlobRef{Hash: hex.EncodeToString(h.Sum(nil)), Size: size}
+	path := i.blobPath(ref.Hash)
+	if _, statErr := os.Stat(path); statErr == nil {
+		// the blob is already stored, so renew it to protect it from garbage collection until it is referenced
+		now := time.Now()
+		err = os.Chtimes(path, now, now)
+		return
+	}
+	err = os.Rename(tmp.Name(), path)
+	return
+}
+
+// OpenBlob opens the blob of the document with the given ID, returning the file and the document. The caller must close the file.
+func (i *Index) OpenBlob(id string) (f *os.File, doc *Document, err error) {
+	err = i.view(func(m map[string]Document) error {
+		d, ok := m[id]
+		if !ok || d.Deleted || d.Blob == nil || isExpired(d, time.Now().Unix()) {
+			return fmt.Errorf("Blob not found for id %v", id)
+		}
+		if f, err = os.Open(i.blobPath(d.Blob.Hash)); err != nil {
+			return fmt.Errorf("Unable to open blob %v of %v: %v", d.Blob.Hash, id, err)
+		}
+		exported, err := i.export(d)
+		if err != nil {
+			f.Close()
+			f = nil
+			return err
+		}
+		doc = &exported
+		return nil
+	})
+	return
+}
+
+// checkBlob clears the blob of tombstones, and checks that a document's blob is stored with the size it claims
+func (i *Index) checkBlob(d *Document) error {
+	if d.Deleted {
+		d.Blob = nil
+	}
+	if d.Blob == nil {
+		return nil
+	}
+	if d.IsManifest() {
+		return fmt.Errorf("Invalid manifest %v: manifests cannot have blobs", d.ID)
+	}
+	if !isBlobHash(d.Blob.Hash) {
+		return fmt.Errorf("Invalid document %v: blob hash must be a hex-encoded SHA-256 hash", d.ID)
+	}
+	info, err := os.Stat(i.blobPath(d.Blob.Hash))
+	if err != nil || info.Size() != d.Blob.Size {
+		return fmt.Errorf("Invalid document %v: blob %v is not stored", d.ID, d.Blob.Hash)
+	}
+	return nil
+}
+
+// blobRefs returns the hashes of the blobs referenced by documents or by the previous versions kept for history and restoring.
+// It must be called while holding the store's lock.
+func (i *Index) blobRefs(m map[string]Document) (IDSet, error) {
+	refs := IDSet{}
+	for _, d := range m {
+		if d.Blob != nil {
+			refs[d.Blob.Hash] = SetEntry{}
+		}
+	}
+	for _, side := range []string{historySide, trashSide} {
+		if err := i.docs.forEachSide(side, "", func(k string, bz []byte) error {
+			stored := storedDocument{}
+			if err := mp.Unmarshal(bz, &stored); err != nil {
+				return fmt.Errorf("Unable to decode %v entry %v: %v", side, k, err)
+			}
+			if stored.Doc.Blob != nil {
+				refs[stored.Doc.Blob.Hash] = SetEntry{}
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// CollectBlobs removes blob files that have not been written for `grace` and are not referenced by any document,
+// including the previous versions kept for history and restoring. It returns the number of blobs removed.
+func (i *Index) CollectBlobs(grace time.Duration) (removed int, err error) {
+	err = i.view(func(m map[string]Document) error {
+		files, err := ioutil.ReadDir(i.blobDir())
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		refs, err := i.blobRefs(m)
+		if err != nil {
+			return err
+		}
+
+		cutoff := time.Now().Add(-grace)
+		for _, file := range files {
+			if _, ok := refs[file.Name()]; ok || file.ModTime().After(cutoff) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(i.blobDir(), file.Name())); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return
+}
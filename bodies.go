@@ -0,0 +1,130 @@
+package mcache
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// bodiesSide is the side bucket holding the store's content-addressed body area, which maps the hash of each body to the body.
+// bodyRefsSide counts the documents that refer to each body, so a body is stored once however many documents share it
+// and is removed when the last of them changes.
+const bodiesSide = "bodies"
+const bodyRefsSide = "bodyrefs"
+
+// hashBody returns the hex-encoded SHA-256 hash of a body
+func hashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashBody returns the hash of a document's body, which is keyed by the index's data key if the index is encrypted
+func (i *Index) hashBody(body []byte) string {
+	if i.cipher != nil {
+		return i.cipher.hash(body)
+	}
+	return hashBody(body)
+}
+
+// loadBodies reads every body in the body area, or none if the bucket does not exist yet
+func loadBodies(b *bolt.Bucket) (map[string][]byte, error) {
+	bodies := map[string][]byte{}
+	if b == nil {
+		return bodies, nil
+	}
+	err := b.ForEach(func(k, v []byte) error {
+		bodies[string(k)] = append([]byte{}, v...)
+		return nil
+	})
+	return bodies, err
+}
+
+// bodyRefs collects the changes a transaction makes to the reference counts of bodies
+type bodyRefs struct {
+	counts map[string]int64
+	data   map[string][]byte
+	// keys maps each written document to the key of its body, or "" if its body is stored inline
+	keys map[string]string
+}
+
+func newBodyRefs() *bodyRefs {
+	return &bodyRefs{map[string]int64{}, map[string][]byte{}, map[string]string{}}
+}
+
+// add references a body, returning its key
+func (r *bodyRefs) add(body []byte) string {
+	key := hashBody(body)
+	r.counts[key]++
+	r.data[key] = body
+	return key
+}
+
+// remove drops a reference to the body with the given key, if any
+func (r *bodyRefs) remove(key string) {
+	if key != "" {
+		r.counts[key]--
+	}
+}
+
+// commit applies the changed reference counts, storing new bodies and removing bodies that are no longer referenced
+func (r *bodyRefs) commit(btx *bolt.Tx, s *docStore) error {
+	if len(r.counts) == 0 {
+		return nil
+	}
+	bodies, err := btx.CreateBucketIfNotExists(s.sideBucket(bodiesSide))
+	if err != nil {
+		return err
+	}
+	refs, err := btx.CreateBucketIfNotExists(s.sideBucket(bodyRefsSide))
+	if err != nil {
+		return err
+	}
+
+	for key, change := range r.counts {
+		if change == 0 {
+			continue
+		}
+		count := int64(0)
+		if bz := refs.Get([]byte(key)); len(bz) == 8 {
+			count = int64(binary.BigEndian.Uint64(bz))
+		}
+		count += change
+
+		if count <= 0 {
+			if err := refs.Delete([]byte(key)); err != nil {
+				return err
+			}
+			if err := bodies.Delete([]byte(key)); err != nil {
+				return err
+			}
+			continue
+		}
+		bz := make([]byte, 8)
+		binary.BigEndian.PutUint64(bz, uint64(count))
+		if err := refs.Put([]byte(key), bz); err != nil {
+			return err
+		}
+		if bodies.Get([]byte(key)) == nil {
+			if err := bodies.Put([]byte(key), r.data[key]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateDocumentBodies hashes documents stored before bodies were hashed, rewriting them so their bodies move into the body area
+func migrateDocumentBodies(docs *docStore) error {
+	return docs.UpdateMap(func(tx *storeTx) error {
+		for id, d := range tx.m {
+			if d.Deleted || d.Hash != "" {
+				continue
+			}
+			d.Hash = hashBody(d.Body)
+			tx.Set(id, d)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,356 @@
+package mcache
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// Cache policies that can be selected with Config.CachePolicy
+const (
+	// CachePolicyLRU is a size-aware LRU cache shared by all indexes and bounded by Config.CacheBytes
+	CachePolicyLRU = "lru"
+	// CachePolicy2Q is a per-index 2Q cache holding up to Config.CacheEntries documents
+	CachePolicy2Q = "2q"
+	// CachePolicyARC is a per-index adaptive replacement cache holding up to Config.CacheEntries documents
+	CachePolicyARC = "arc"
+	// CachePolicyNone disables caching, so every read goes to the store
+	CachePolicyNone = "none"
+)
+
+// DocCache caches an index's documents in memory. Implementations must be safe for concurrent use.
+type DocCache interface {
+	Get(docID string) (Document, bool)
+	Add(doc Document)
+	Remove(docID string)
+	Keys() []string
+	Purge()
+	// Full returns true if adding more documents would evict others
+	Full() bool
+}
+
+// CacheFactory creates the DocCache for the index with the given ID
+type CacheFactory func(indexID string) (DocCache, error)
+
+// NewCacheFactory returns a CacheFactory for the cache policy described by `config`
+func NewCacheFactory(config Config) (CacheFactory, error) {
+	config = config.withDeprecated()
+	switch config.CachePolicy {
+	case CachePolicyLRU, "":
+		shared := NewSharedCache(config.CacheBytes)
+		return func(indexID string) (DocCache, error) {
+			return shared.ForIndex(indexID), nil
+		}, nil
+	case CachePolicy2Q:
+		return func(string) (DocCache, error) {
+			cache, err := lru.New2Q(config.CacheEntries)
+			if err != nil {
+				return nil, err
+			}
+			return &twoQueueCache{cache, config.CacheEntries}, nil
+		}, nil
+	case CachePolicyARC:
+		return func(string) (DocCache, error) {
+			cache, err := lru.NewARC(config.CacheEntries)
+			if err != nil {
+				return nil, err
+			}
+			return &arcCache{cache, config.CacheEntries}, nil
+		}, nil
+	case CachePolicyNone:
+		return func(string) (DocCache, error) {
+			return noopCache{}, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown cache policy %v", config.CachePolicy)
+}
+
+// cacheEntryOverhead approximates the memory used by a cache entry in addition to its document's ID and body
+const cacheEntryOverhead = 128
+
+// SharedCache is an LRU cache of documents shared by every index, bounded by the total size of the documents it holds.
+// When it is over budget, it evicts the least recently used documents of whichever index holds the most bytes, so one busy index cannot evict everyone else.
+type SharedCache struct {
+	mut       *sync.Mutex
+	maxBytes  int64
+	usedBytes int64
+	segments  map[string]*cacheSegment
+}
+
+// cacheSegment holds one index's cached documents in LRU order
+type cacheSegment struct {
+	entries *list.List
+	items   map[string]*list.Element
+	bytes   int64
+}
+
+type cacheEntry struct {
+	doc  Document
+	size int64
+}
+
+// NewSharedCache returns a SharedCache that holds at most `maxBytes` of documents
+func NewSharedCache(maxBytes int64) *SharedCache {
+	return &SharedCache{&sync.Mutex{}, maxBytes, 0, map[string]*cacheSegment{}}
+}
+
+// ForIndex returns a view of the cache that holds the documents of the index with the given ID
+func (c *SharedCache) ForIndex(indexID string) *IndexCache {
+	return &IndexCache{c, indexID}
+}
+
+// UsedBytes returns the approximate size of all cached documents
+func (c *SharedCache) UsedBytes() int64 {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.usedBytes
+}
+
+func (c *SharedCache) get(indexID, docID string) (Document, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	seg := c.segments[indexID]
+	if seg == nil {
+		return Document{}, false
+	}
+	el, ok := seg.items[docID]
+	if !ok {
+		return Document{}, false
+	}
+	seg.entries.MoveToFront(el)
+	return el.Value.(*cacheEntry).doc, true
+}
+
+func (c *SharedCache) add(indexID string, doc Document) {
+	size := documentSize(doc)
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if seg := c.segments[indexID]; seg != nil {
+		c.unsafeRemove(indexID, seg, doc.ID)
+	}
+	if size > c.maxBytes {
+		return
+	}
+
+	seg := c.segments[indexID]
+	if seg == nil {
+		seg = &cacheSegment{list.New(), map[string]*list.Element{}, 0}
+		c.segments[indexID] = seg
+	}
+
+	seg.items[doc.ID] = seg.entries.PushFront(&cacheEntry{doc, size})
+	seg.bytes += size
+	c.usedBytes += size
+
+	for c.usedBytes > c.maxBytes {
+		c.unsafeEvict()
+	}
+}
+
+func (c *SharedCache) remove(indexID, docID string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if seg := c.segments[indexID]; seg != nil {
+		c.unsafeRemove(indexID, seg, docID)
+	}
+}
+
+func (c *SharedCache) keys(indexID string) []string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	seg := c.segments[indexID]
+	if seg == nil {
+		return []string{}
+	}
+	keys := make([]string, 0, len(seg.items))
+	for k := range seg.items {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// full returns true if the index is using at least its fair share of the budget
+func (c *SharedCache) full(indexID string) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	seg := c.segments[indexID]
+	if seg == nil {
+		return c.maxBytes <= 0
+	}
+	return seg.bytes >= c.maxBytes/int64(len(c.segments))
+}
+
+func (c *SharedCache) purge(indexID string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if seg := c.segments[indexID]; seg != nil {
+		c.usedBytes -= seg.bytes
+		delete(c.segments, indexID)
+	}
+}
+
+func (c *SharedCache) unsafeRemove(indexID string, seg *cacheSegment, docID string) {
+	el, ok := seg.items[docID]
+	if !ok {
+		return
+	}
+	size := seg.entries.Remove(el).(*cacheEntry).size
+	delete(seg.items, docID)
+	seg.bytes -= size
+	c.usedBytes -= size
+	if len(seg.items) == 0 {
+		delete(c.segments, indexID)
+	}
+}
+
+// unsafeEvict removes the least recently used document of the index using the most bytes
+func (c *SharedCache) unsafeEvict() {
+	var victimID string
+	var victim *cacheSegment
+	for id, seg := range c.segments {
+		if victim == nil || seg.bytes > victim.bytes {
+			victimID, victim = id, seg
+		}
+	}
+	if victim == nil {
+		c.usedBytes = 0
+		return
+	}
+	c.unsafeRemove(victimID, victim, victim.entries.Back().Value.(*cacheEntry).doc.ID)
+}
+
+// IndexCache is the part of a SharedCache that holds a single index's documents
+type IndexCache struct {
+	shared  *SharedCache
+	indexID string
+}
+
+// Get returns the cached document with the given ID, marking it as recently used
+func (c *IndexCache) Get(docID string) (Document, bool) {
+	return c.shared.get(c.indexID, docID)
+}
+
+// Add adds or replaces a document in the cache
+func (c *IndexCache) Add(doc Document) {
+	c.shared.add(c.indexID, doc)
+}
+
+// Remove removes the document with the given ID from the cache
+func (c *IndexCache) Remove(docID string) {
+	c.shared.remove(c.indexID, docID)
+}
+
+// Keys returns the IDs of all cached documents
+func (c *IndexCache) Keys() []string {
+	return c.shared.keys(c.indexID)
+}
+
+// Purge removes all of the index's documents from the cache
+func (c *IndexCache) Purge() {
+	c.shared.purge(c.indexID)
+}
+
+// Full returns true if the index is using at least its fair share of the cache
+func (c *IndexCache) Full() bool {
+	return c.shared.full(c.indexID)
+}
+
+func documentSize(doc Document) int64 {
+	size := len(doc.ID) + len(doc.Body) + len(doc.ContentType) + len(doc.Hash) + cacheEntryOverhead
+	for k, v := range doc.Meta {
+		size += len(k) + len(v)
+	}
+	if doc.Blob != nil {
+		size += len(doc.Blob.Hash) + len(doc.Blob.ContentType)
+	}
+	return int64(size)
+}
+
+// twoQueueCache is a DocCache backed by a 2Q cache
+type twoQueueCache struct {
+	cache *lru.TwoQueueCache
+	size  int
+}
+
+func (c *twoQueueCache) Get(docID string) (Document, bool) {
+	v, ok := c.cache.Get(docID)
+	if !ok {
+		return Document{}, false
+	}
+	return v.(Document), true
+}
+
+func (c *twoQueueCache) Add(doc Document) {
+	c.cache.Add(doc.ID, doc)
+}
+
+func (c *twoQueueCache) Remove(docID string) {
+	c.cache.Remove(docID)
+}
+
+func (c *twoQueueCache) Keys() []string {
+	return stringKeys(c.cache.Keys())
+}
+
+func (c *twoQueueCache) Purge() {
+	c.cache.Purge()
+}
+
+func (c *twoQueueCache) Full() bool {
+	return c.cache.Len() >= c.size
+}
+
+// arcCache is a DocCache backed by an adaptive replacement cache
+type arcCache struct {
+	cache *lru.ARCCache
+	size  int
+}
+
+func (c *arcCache) Get(docID string) (Document, bool) {
+	v, ok := c.cache.Get(docID)
+	if !ok {
+		return Document{}, false
+	}
+	return v.(Document), true
+}
+
+func (c *arcCache) Add(doc Document) {
+	c.cache.Add(doc.ID, doc)
+}
+
+func (c *arcCache) Remove(docID string) {
+	c.cache.Remove(docID)
+}
+
+func (c *arcCache) Keys() []string {
+	return stringKeys(c.cache.Keys())
+}
+
+func (c *arcCache) Purge() {
+	c.cache.Purge()
+}
+
+func (c *arcCache) Full() bool {
+	return c.cache.Len() >= c.size
+}
+
+// noopCache is a DocCache that never holds any documents
+type noopCache struct{}
+
+func (noopCache) Get(string) (Document, bool) { return Document{}, false }
+func (noopCache) Add(Document)                {}
+func (noopCache) Remove(string)               {}
+func (noopCache) Keys() []string              { return []string{} }
+func (noopCache) Purge()                      {}
+func (noopCache) Full() bool                  { return true }
+
+func stringKeys(keys []interface{}) []string {
+	strs := make([]string, len(keys))
+	for n, k := range keys {
+		strs[n] = k.(string)
+	}
+	return strs
+}
@@ -0,0 +1,180 @@
+package mcache
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	mp "github.com/vmihailenco/msgpack"
+)
+
+// deflateEncoding marks a stored body compressed with DEFLATE (RFC 1951)
+const deflateEncoding = "deflate"
+
+// encodeBody compresses the body of a stored document if the index's settings call for it and compression makes it smaller,
+// then encrypts it if the index is encrypted. Manifest bodies are already compact, so they are only encrypted. The body must not already be encoded.
+func (i *Index) encodeBody(d Document) (Document, error) {
+	if d.Deleted || len(d.Body) == 0 {
+		return d, nil
+	}
+
+	encodings := []string{}
+	if threshold := i.settings.CompressionThreshold; threshold > 0 && !d.IsManifest() && len(d.Body) >= threshold {
+		compressed, err := compress(d.Body)
+		if err != nil {
+			return d, err
+		}
+		if len(compressed) < len(d.Body) {
+			d.Body = compressed
+			encodings = append(encodings, deflateEncoding)
+		}
+	}
+	if i.cipher != nil {
+		d.Body = i.cipher.encrypt(d.Body)
+		encodings = append(encodings, aesGCMEncoding)
+	}
+	d.Encoding = strings.Join(encodings, "+")
+	return d, nil
+}
+
+// decodeBody returns a stored document with its body decrypted and decompressed
+func (i *Index) decodeBody(d Document) (Document, error) {
+	return decodeStoredBody(i.cipher, d)
+}
+
+// decodeStoredBody is like decodeBody, for when the index's store is not set up yet
+func decodeStoredBody(cipher *bodyCipher, d Document) (Document, error) {
+	if d.Encoding == "" {
+		return d, nil
+	}
+	encodings := strings.Split(d.Encoding, "+")
+	body := d.Body
+	for n := len(encodings) - 1; n >= 0; n-- {
+		var err error
+		switch encodings[n] {
+		case deflateEncoding:
+			if body, err = decompress(body); err != nil {
+				return d, fmt.Errorf("Unable to decompress body of %v: %v", d.ID, err)
+			}
+		case aesGCMEncoding:
+			if cipher == nil {
+				return d, fmt.Errorf("Unable to decrypt body of %v: the index has no data key", d.ID)
+			}
+			if body, err = cipher.decrypt(body); err != nil {
+				return d, fmt.Errorf("Unable to decrypt body of %v: %v", d.ID, err)
+			}
+		default:
+			return d, fmt.Errorf("Unknown encoding %v of document %v", encodings[n], d.ID)
+		}
+	}
+	d.Body = body
+	d.Encoding = ""
+	return d, nil
+}
+
+func compress(body []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(body); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(body []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(body))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Recompress rewrites the bodies of stored documents to match the index's current compression settings and encryption,
+// compressing, decompressing or encrypting them as needed, along with the previous versions kept for history and restoring.
+// Hashes are recomputed, since they are keyed in encrypted indexes. Documents keep their versions and timestamps,
+// since their contents do not change. It returns the number of documents and previous versions rewritten.
+func (i *Index) Recompress() (rewritten int, err error) {
+	err = i.use(func() error {
+		return i.docs.UpdateMap(func(tx *storeTx) error {
+			n, err := i.recodeAll(tx)
+			if err != nil {
+				return err
+			}
+			tx.OnCommit(func() {
+				rewritten = n
+			})
+			return nil
+		})
+	})
+	return
+}
+
+// recodeAll re-encodes every stored document and previous version within `tx` (see Recompress), returning how many changed
+func (i *Index) recodeAll(tx *storeTx) (int, error) {
+	written := []Document{}
+	for id, d := range tx.m {
+		encoded, changed, err := i.recodeBody(d)
+		if err != nil {
+			return 0, err
+		}
+		if changed {
+			tx.Set(id, encoded)
+			written = append(written, encoded)
+		}
+	}
+
+	versions := 0
+	for _, side := range []string{historySide, trashSide} {
+		if err := tx.ForEach(side, "", func(k string, bz []byte) error {
+			stored := storedDocument{}
+			if err := mp.Unmarshal(bz, &stored); err != nil {
+				return fmt.Errorf("Unable to decode %v entry %v: %v", side, k, err)
+			}
+			encoded, changed, err := i.recodeBody(stored.Doc)
+			if err != nil || !changed {
+				return err
+			}
+			if bz, err = mp.Marshal(storedDocument{Doc: encoded}); err != nil {
+				return err
+			}
+			tx.Put(side, k, bz)
+			versions++
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	tx.OnCommit(func() {
+		for _, d := range written {
+			i.cache.Add(d)
+		}
+	})
+	return len(written) + versions, nil
+}
+
+// recodeBody encodes the body of a stored document with the index's current settings, returning false if it would not change
+func (i *Index) recodeBody(d Document) (Document, bool, error) {
+	if d.Deleted {
+		return d, false, nil
+	}
+	plain, err := i.decodeBody(d)
+	if err != nil {
+		return d, false, err
+	}
+	encoded, err := i.encodeBody(plain)
+	if err != nil {
+		return d, false, err
+	}
+	encoded.Hash = i.hashBody(plain.Body)
+	if encoded.Encoding == d.Encoding && encoded.Hash == d.Hash {
+		return d, false, nil
+	}
+	return encoded, true, nil
+}
@@ -0,0 +1,159 @@
+package mcache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// cursorsSide is the side bucket holding the cursor of each client for each manifest, keyed by cursorKey
+const cursorsSide = "cursors"
+
+// MaxClientIDLength limits the length of the client IDs that queries are made as
+const MaxClientIDLength = 128
+
+// clientCursors maps each manifest ID to the cursor of each client that has queried it.
+// Any query also records the anonymous client "", which only marks that the manifest has been queried, since its queries may come from any client.
+type clientCursors map[string]map[string]clientCursor
+
+// clientCursor is the `after` a client last queried a manifest from, and when it did
+type clientCursor struct {
+	after  Timestamp
+	seenAt Timestamp
+}
+
+func cursorKey(manifestID, clientID string) string {
+	return manifestID + "\x00" + clientID
+}
+
+func validateClientID(clientID string) error {
+	if len(clientID) > MaxClientIDLength || strings.ContainsRune(clientID, 0) {
+		return fmt.Errorf("Invalid client ID: must be at most %v bytes without NUL characters", MaxClientIDLength)
+	}
+	return nil
+}
+
+// recordCursors notes that a client has queried manifests from `after`, so it has seen every change to them up to then.
+// A named client's cursor moves to its latest query. Anonymous queries only mark the manifests as queried.
+func (i *Index) recordCursors(clientID string, manifestIDs IDSet, after Timestamp) {
+	now := time.Now().Unix()
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	for manifestID := range manifestIDs {
+		clients := i.cursors[manifestID]
+		if clients == nil {
+			clients = map[string]clientCursor{}
+			i.cursors[manifestID] = clients
+		}
+		if _, queried := clients[""]; !queried {
+			clients[""] = clientCursor{seenAt: now}
+			i.pendingCursors[cursorKey(manifestID, "")] = clients[""]
+		}
+		if clientID == "" {
+			continue
+		}
+		cursor := clientCursor{after, now}
+		if clients[clientID] == cursor {
+			continue
+		}
+		clients[clientID] = cursor
+		i.pendingCursors[cursorKey(manifestID, clientID)] = cursor
+	}
+}
+
+// expireCursors forgets the cursors of clients that have not queried a manifest since `cutoff`, returning their keys so they can be removed from the store.
+// Such clients may have missed tombstones that were compacted, and must sync the manifest again from the start.
+func (i *Index) expireCursors(cutoff Timestamp) []string {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	expired := []string{}
+	for manifestID, clients := range i.cursors {
+		for clientID, cursor := range clients {
+			if clientID == "" || cursor.seenAt >= cutoff {
+				continue
+			}
+			key := cursorKey(manifestID, clientID)
+			delete(clients, clientID)
+			delete(i.pendingCursors, key)
+			expired = append(expired, key)
+		}
+	}
+	return expired
+}
+
+// takeCursors returns a copy of every known cursor, along with the cursors that have not been stored yet, which the caller must store
+func (i *Index) takeCursors() (cursors clientCursors, pending map[string]clientCursor) {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	cursors = make(clientCursors, len(i.cursors))
+	for manifestID, clients := range i.cursors {
+		cursors[manifestID] = make(map[string]clientCursor, len(clients))
+		for clientID, cursor := range clients {
+			cursors[manifestID][clientID] = cursor
+		}
+	}
+	pending = i.pendingCursors
+	i.pendingCursors = map[string]clientCursor{}
+	return
+}
+
+// restorePendingCursors puts back cursors that could not be stored, unless they have been recorded again since
+func (i *Index) restorePendingCursors(pending map[string]clientCursor) {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	for key, cursor := range pending {
+		if _, ok := i.pendingCursors[key]; !ok {
+			i.pendingCursors[key] = cursor
+		}
+	}
+}
+
+func putCursors(tx *storeTx, cursors map[string]clientCursor) {
+	for key, cursor := range cursors {
+		bz := make([]byte, 16)
+		binary.BigEndian.PutUint64(bz, uint64(cursor.after))
+		binary.BigEndian.PutUint64(bz[8:], uint64(cursor.seenAt))
+		tx.Put(cursorsSide, key, bz)
+	}
+}
+
+// loadCursors adds the stored cursors to those recorded in memory, which are never older. It must be called while holding the index's lock.
+// Cursors stored without the time they were seen are treated as seen when they are loaded.
+func (i *Index) loadCursors(docs *docStore) error {
+	now := time.Now().Unix()
+	return docs.ForEach(cursorsSide, "", func(k string, bz []byte) error {
+		parts := strings.SplitN(k, "\x00", 2)
+		if len(parts) != 2 || (len(bz) != 8 && len(bz) != 16) {
+			return fmt.Errorf("Unable to decode cursor of manifest %v", parts[0])
+		}
+		cursor := clientCursor{Timestamp(binary.BigEndian.Uint64(bz)), now}
+		if len(bz) == 16 {
+			cursor.seenAt = Timestamp(binary.BigEndian.Uint64(bz[8:]))
+		}
+		clients := i.cursors[parts[0]]
+		if clients == nil {
+			clients = map[string]clientCursor{}
+			i.cursors[parts[0]] = clients
+		}
+		if _, ok := clients[parts[1]]; !ok {
+			clients[parts[1]] = cursor
+		}
+		return nil
+	})
+}
+
+// storePendingCursors stores the cursors recorded since they were last stored. It must be called while holding the index's lock.
+func (i *Index) storePendingCursors() error {
+	if len(i.pendingCursors) == 0 {
+		return nil
+	}
+	err := i.docs.UpdateMap(func(tx *storeTx) error {
+		putCursors(tx, i.pendingCursors)
+		return nil
+	})
+	if err == nil {
+		i.pendingCursors = map[string]clientCursor{}
+	}
+	return err
+}
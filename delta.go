@@ -0,0 +1,198 @@
+package mcache
+
+import (
+	"bytes"
+	"fmt"
+
+	mp "github.com/vmihailenco/msgpack"
+)
+
+// deltaFormat is the first byte of a delta. It is followed by the length of the target,
+// then a sequence of instructions that each either copy a range of the base or insert literal bytes.
+const deltaFormat byte = 0x01
+
+// Delta instructions
+const (
+	// deltaCopy is followed by the offset and length of a range of the base
+	deltaCopy byte = 0
+	// deltaInsert is followed by a length and that many literal bytes
+	deltaInsert byte = 1
+)
+
+// deltaBlockSize is the length of the blocks of the base that a delta can match, so shorter common runs are sent as literals
+const deltaBlockSize = 16
+
+// deltaHashBase is the multiplier of the rolling hash used to find matching blocks
+const deltaHashBase uint32 = 257
+
+// ComputeDelta returns a delta that turns `base` into `target` when passed to ApplyDelta
+func ComputeDelta(base, target []byte) []byte {
+	delta := []byte{deltaFormat}
+	delta = appendUvarint(delta, uint64(len(target)))
+	if len(base) < deltaBlockSize || len(target) < deltaBlockSize {
+		return appendInsert(delta, target)
+	}
+
+	// index the base's non-overlapping blocks by hash, keeping the first of any repeats
+	blocks := map[uint32]int{}
+	for off := 0; off+deltaBlockSize <= len(base); off += deltaBlockSize {
+		h := blockHash(base[off : off+deltaBlockSize])
+		if _, ok := blocks[h]; !ok {
+			blocks[h] = off
+		}
+	}
+
+	pow := uint32(1)
+	for n := 1; n < deltaBlockSize; n++ {
+		pow *= deltaHashBase
+	}
+
+	literal := 0
+	p := 0
+	h := blockHash(target[:deltaBlockSize])
+	for p+deltaBlockSize <= len(target) {
+		if off, ok := blocks[h]; ok && bytes.Equal(base[off:off+deltaBlockSize], target[p:p+deltaBlockSize]) {
+			start := p
+			for start > literal && off > 0 && base[off-1] == target[start-1] {
+				start--
+				off--
+			}
+			n := p - start + deltaBlockSize
+			for off+n < len(base) && start+n < len(target) && base[off+n] == target[start+n] {
+				n++
+			}
+
+			delta = appendInsert(delta, target[literal:start])
+			delta = append(delta, deltaCopy)
+			delta = appendUvarint(delta, uint64(off))
+			delta = appendUvarint(delta, uint64(n))
+			p = start + n
+			literal = p
+			if p+deltaBlockSize <= len(target) {
+				h = blockHash(target[p : p+deltaBlockSize])
+			}
+			continue
+		}
+
+		if p+deltaBlockSize < len(target) {
+			h = (h-uint32(target[p])*pow)*deltaHashBase + uint32(target[p+deltaBlockSize])
+		}
+		p++
+	}
+
+	return appendInsert(delta, target[literal:])
+}
+
+// ApplyDelta applies a delta made by ComputeDelta to the base it was computed against
+func ApplyDelta(base, delta []byte) ([]byte, error) {
+	if len(delta) == 0 || delta[0] != deltaFormat {
+		return nil, fmt.Errorf("Unknown delta format")
+	}
+	bz := delta[1:]
+	size, err := readDeltaUvarint(&bz)
+	if err != nil {
+		return nil, err
+	}
+	// the target length is not trusted for preallocation, since a corrupt delta could claim any length
+	capacity := uint64(len(base) + len(delta))
+	if size < capacity {
+		capacity = size
+	}
+
+	target := make([]byte, 0, capacity)
+	for len(bz) > 0 {
+		op := bz[0]
+		bz = bz[1:]
+		switch op {
+		case deltaCopy:
+			off, err := readDeltaUvarint(&bz)
+			if err != nil {
+				return nil, err
+			}
+			n, err := readDeltaUvarint(&bz)
+			if err != nil {
+				return nil, err
+			}
+			if off > uint64(len(base)) || n > uint64(len(base))-off {
+				return nil, fmt.Errorf("Corrupt delta: copy is outside the base")
+			}
+			target = append(target, base[off:off+n]...)
+		case deltaInsert:
+			n, err := readDeltaUvarint(&bz)
+			if err != nil {
+				return nil, err
+			}
+			if n > uint64(len(bz)) {
+				return nil, fmt.Errorf("Corrupt delta: insert is truncated")
+			}
+			target = append(target, bz[:n]...)
+			bz = bz[n:]
+		default:
+			return nil, fmt.Errorf("Corrupt delta: unknown instruction %v", op)
+		}
+		if uint64(len(target)) > size {
+			return nil, fmt.Errorf("Corrupt delta: target is longer than expected")
+		}
+	}
+
+	if uint64(len(target)) != size {
+		return nil, fmt.Errorf("Corrupt delta: target is shorter than expected")
+	}
+	return target, nil
+}
+
+// encodeDeltas replaces the body of each document whose previous version the client holds with a delta against that version,
+// if the version is still in the index's history and the delta is smaller than the body. It must be called while holding the store's lock.
+func (i *Index) encodeDeltas(docs *DocSet, known map[string]int64) {
+	for id, version := range known {
+		d, ok := docs.Docs[id]
+		if !ok || d.Deleted || d.IsManifest() || version <= 0 || version >= d.Version {
+			continue
+		}
+		bz, err := i.docs.loadSide(historySide, historyKey(id, version))
+		if err != nil || bz == nil {
+			continue
+		}
+		base := storedDocument{}
+		if err = mp.Unmarshal(bz, &base); err != nil || base.Doc.Deleted {
+			continue
+		}
+		if base.Doc, err = i.decodeBody(base.Doc); err != nil {
+			continue
+		}
+
+		delta := ComputeDelta(base.Doc.Body, d.Body)
+		if len(delta) >= len(d.Body) {
+			continue
+		}
+		d.Body = nil
+		d.Delta = delta
+		d.BaseVersion = version
+		docs.Docs[id] = d
+	}
+}
+
+func appendInsert(delta []byte, literal []byte) []byte {
+	if len(literal) == 0 {
+		return delta
+	}
+	delta = append(delta, deltaInsert)
+	delta = appendUvarint(delta, uint64(len(literal)))
+	return append(delta, literal...)
+}
+
+func readDeltaUvarint(bz *[]byte) (uint64, error) {
+	v, err := readUvarint(bz)
+	if err != nil {
+		return 0, fmt.Errorf("Corrupt delta")
+	}
+	return v, nil
+}
+
+func blockHash(block []byte) uint32 {
+	h := uint32(0)
+	for _, c := range block {
+		h = h*deltaHashBase + uint32(c)
+	}
+	return h
+}
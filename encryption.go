@@ -0,0 +1,226 @@
+package mcache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// keysSide is the side bucket holding an index's data key, under dataKeyName, wrapped by the master key
+const keysSide = "keys"
+const dataKeyName = "data"
+
+// unencryptedName is set in the keys side bucket while documents written before the index had a data key are not encrypted yet
+const unencryptedName = "unencrypted"
+
+// aesGCMEncoding marks a stored body encrypted with the index's data key
+const aesGCMEncoding = "aes-gcm"
+
+// MasterKeySize is the length of master keys, which are AES-256 keys
+const MasterKeySize = 32
+
+// wrappedKey is a data key encrypted by a master key, stored with an identifier of the master key
+type wrappedKey struct {
+	MasterKeyID string `json:"masterKeyID"`
+	Key         []byte `json:"key"`
+}
+
+// bodyCipher encrypts the bodies of an index's documents with the index's data key
+type bodyCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+	hashKey  []byte
+}
+
+func validateMasterKeys(config Config) error {
+	if len(config.MasterKey) == 0 && len(config.PreviousMasterKeys) > 0 {
+		return fmt.Errorf("Invalid master key: previous master keys require a current master key")
+	}
+	for _, key := range append([][]byte{config.MasterKey}, config.PreviousMasterKeys...) {
+		if len(key) != 0 && len(key) != MasterKeySize {
+			return fmt.Errorf("Invalid master key: must be %v bytes", MasterKeySize)
+		}
+	}
+	return nil
+}
+
+// masterKeyID identifies a master key without revealing it
+func masterKeyID(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("mcache master key id"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts `plaintext`, prefixing the result with the nonce
+func seal(aead cipher.AEAD, nonce, plaintext []byte) []byte {
+	return aead.Seal(append([]byte{}, nonce...), nonce, plaintext, nil)
+}
+
+// unseal decrypts the output of seal
+func unseal(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+func wrapDataKey(master, dataKey []byte) (w wrappedKey, err error) {
+	aead, err := newAEAD(master)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	return wrappedKey{masterKeyID(master), seal(aead, nonce, dataKey)}, nil
+}
+
+func unwrapDataKey(master []byte, w wrappedKey) ([]byte, error) {
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	return unseal(aead, w.Key)
+}
+
+// loadDataKey returns the cipher for an index's bodies, or nil if the index is not encrypted. An index that has no data key gets one
+// if a master key is configured, and its existing documents are then encrypted when it is opened (see Index.encryptExisting). A data key wrapped by one of the previous master keys is re-wrapped by the current master key,
+// so master keys can be rotated without rewriting any documents. Indexes whose data key cannot be unwrapped are refused.
+func loadDataKey(docs *docStore, config Config) (*bodyCipher, error) {
+	bz, err := docs.Load(keysSide, dataKeyName)
+	if err != nil {
+		return nil, err
+	}
+
+	if bz == nil {
+		if len(config.MasterKey) == 0 {
+			return nil, nil
+		}
+		dataKey := make([]byte, 32)
+		if _, err = rand.Read(dataKey); err != nil {
+			return nil, err
+		}
+		if err = storeDataKey(docs, config.MasterKey, dataKey, true); err != nil {
+			return nil, err
+		}
+		return newBodyCipher(dataKey)
+	}
+
+	w := wrappedKey{}
+	if err = json.Unmarshal(bz, &w); err != nil {
+		return nil, fmt.Errorf("Unable to decode data key: %v", err)
+	}
+	if len(config.MasterKey) == 0 {
+		return nil, fmt.Errorf("Index %v is encrypted, but no master key is configured", docs.name)
+	}
+	for _, master := range append([][]byte{config.MasterKey}, config.PreviousMasterKeys...) {
+		if masterKeyID(master) != w.MasterKeyID {
+			continue
+		}
+		dataKey, err := unwrapDataKey(master, w)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to unwrap data key of index %v: %v", docs.name, err)
+		}
+		if !bytes.Equal(master, config.MasterKey) {
+			if err = storeDataKey(docs, config.MasterKey, dataKey, false); err != nil {
+				return nil, fmt.Errorf("Unable to re-wrap data key of index %v: %v", docs.name, err)
+			}
+		}
+		return newBodyCipher(dataKey)
+	}
+	return nil, fmt.Errorf("Index %v is encrypted with a master key that is not configured", docs.name)
+}
+
+// storeDataKey wraps and stores a data key. If the key is `created` for an index that already has documents, they are marked as not encrypted yet.
+func storeDataKey(docs *docStore, master, dataKey []byte, created bool) error {
+	w, err := wrapDataKey(master, dataKey)
+	if err != nil {
+		return err
+	}
+	bz, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return docs.UpdateMap(func(tx *storeTx) error {
+		tx.Put(keysSide, dataKeyName, bz)
+		if created && len(tx.m) > 0 {
+			tx.Put(keysSide, unencryptedName, []byte{1})
+		}
+		return nil
+	})
+}
+
+// encryptExisting encrypts the documents and previous versions that were written before the index had a data key, if any.
+// It is called when the index is opened, and is retried at the next open if it fails.
+func (i *Index) encryptExisting() error {
+	if i.cipher == nil {
+		return nil
+	}
+	pending, err := i.docs.Load(keysSide, unencryptedName)
+	if err != nil || pending == nil {
+		return err
+	}
+	rewritten := 0
+	err = i.docs.UpdateMap(func(tx *storeTx) error {
+		n, err := i.recodeAll(tx)
+		if err != nil {
+			return err
+		}
+		tx.Remove(keysSide, unencryptedName)
+		tx.OnCommit(func() {
+			rewritten = n
+		})
+		return nil
+	})
+	if err == nil {
+		i.config.logf("Encrypted %v documents and previous versions of index %v\n", rewritten, i.ID)
+	}
+	return err
+}
+
+func newBodyCipher(dataKey []byte) (*bodyCipher, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &bodyCipher{aead, deriveKey(dataKey, "nonce"), deriveKey(dataKey, "hash")}, nil
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("mcache " + purpose))
+	return mac.Sum(nil)
+}
+
+// encrypt seals a body with a nonce derived from its contents, so identical bodies share a ciphertext and are still stored once
+func (c *bodyCipher) encrypt(body []byte) []byte {
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write(body)
+	return seal(c.aead, mac.Sum(nil)[:c.aead.NonceSize()], body)
+}
+
+func (c *bodyCipher) decrypt(sealed []byte) ([]byte, error) {
+	return unseal(c.aead, sealed)
+}
+
+// hash is a keyed hash of a body, so the hashes of encrypted bodies cannot be used to guess their contents
+func (c *bodyCipher) hash(body []byte) string {
+	mac := hmac.New(sha256.New, c.hashKey)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
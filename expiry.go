@@ -0,0 +1,170 @@
+package mcache
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expiryRetrySeconds is how long to wait before retrying documents that failed to expire
+const expiryRetrySeconds = 10
+
+// expiryQueue holds the expiry times of an open index's documents, soonest first.
+// Entries are not removed when a document is rewritten, so each is checked against the stored document when it is due.
+type expiryQueue struct {
+	mut   *sync.Mutex
+	items expiryHeap
+	wake  chan struct{}
+}
+
+// expiryItem is a document's expiry time, and when to next try expiring it
+type expiryItem struct {
+	id        string
+	expiresAt Timestamp
+	due       Timestamp
+}
+
+func newExpiryQueue() *expiryQueue {
+	return &expiryQueue{&sync.Mutex{}, expiryHeap{}, make(chan struct{}, 1)}
+}
+
+// buildExpiryQueue queues every live document in the store that has an expiry time
+func buildExpiryQueue(docs *docStore) *expiryQueue {
+	q := newExpiryQueue()
+	docs.DoWithMap(func(m map[string]Document) {
+		for id, d := range m {
+			if d.ExpiresAt > 0 && !d.Deleted {
+				q.items = append(q.items, expiryItem{id, d.ExpiresAt, d.ExpiresAt})
+			}
+		}
+	})
+	heap.Init(&q.items)
+	return q
+}
+
+// push queues a document's expiry, waking the worker if it is now the soonest
+func (q *expiryQueue) push(item expiryItem) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	heap.Push(&q.items, item)
+	if q.items[0] == item {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// next returns the time the soonest entry is due, if any
+func (q *expiryQueue) next() (Timestamp, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	if len(q.items) == 0 {
+		return 0, false
+	}
+	return q.items[0].due, true
+}
+
+// popExpired removes and returns every entry due at or before `now`
+func (q *expiryQueue) popExpired(now Timestamp) []expiryItem {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	expired := []expiryItem{}
+	for len(q.items) > 0 && q.items[0].due <= now {
+		expired = append(expired, heap.Pop(&q.items).(expiryItem))
+	}
+	return expired
+}
+
+type expiryHeap []expiryItem
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(a, b int) bool  { return h[a].due < h[b].due }
+func (h expiryHeap) Swap(a, b int)       { h[a], h[b] = h[b], h[a] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryItem)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// applyExpiry clears the expiry of tombstones and gives documents without an expiry the index's default TTL, if it has one
+func (i *Index) applyExpiry(d *Document, now Timestamp) {
+	if d.Deleted {
+		d.ExpiresAt = 0
+	} else if d.ExpiresAt == 0 && d.Kind == DocumentKind && i.settings.DefaultTTLSeconds > 0 {
+		d.ExpiresAt = now + i.settings.DefaultTTLSeconds
+	}
+}
+
+// isExpired returns true if a live document's expiry has passed, even if it has not been replaced with a tombstone yet
+func isExpired(d Document, now Timestamp) bool {
+	return !d.Deleted && d.ExpiresAt > 0 && d.ExpiresAt <= now
+}
+
+// expiredTombstone returns the tombstone that is read in place of an expired document until it is expired
+func expiredTombstone(d Document) Document {
+	return Document{ID: d.ID, Kind: d.Kind, UpdatedAt: d.UpdatedAt, Version: d.Version, Deleted: true}
+}
+
+// expireDocuments replaces documents with tombstones as they expire, until `stop` is closed
+func (i *Index) expireDocuments(q *expiryQueue, stop <-chan struct{}) {
+	for {
+		var due <-chan time.Time
+		var timer *time.Timer
+		if at, ok := q.next(); ok {
+			timer = time.NewTimer(time.Until(time.Unix(at, 0)))
+			due = timer.C
+		}
+
+		select {
+		case <-stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-q.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-due:
+			if !i.expire(q) {
+				// the store is closing, so wait to be stopped
+				<-stop
+				return
+			}
+		}
+	}
+}
+
+// expire replaces every document that is due to expire with a tombstone, so clients learn of the removal when they next sync.
+// It returns false if the index's store is not open.
+func (i *Index) expire(q *expiryQueue) bool {
+	if !i.acquireOpen() {
+		return false
+	}
+	defer i.release()
+
+	now := time.Now().Unix()
+	due := q.popExpired(now)
+	_, err := i.update(func(tx *storeTx) (*DocSet, error) {
+		expired := NewDocSet()
+		for _, item := range due {
+			d, ok := tx.Get(item.id)
+			if ok && !d.Deleted && d.ExpiresAt == item.expiresAt {
+				expired.Add(Document{ID: item.id, Deleted: true})
+			}
+		}
+		return expired, nil
+	})
+
+	if err != nil {
+		i.config.logf("Error expiring documents in index %v: %v\n", i.ID, err)
+		for _, item := range due {
+			item.due = now + expiryRetrySeconds
+			q.push(item)
+		}
+	}
+	return true
+}
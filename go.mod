@@ -7,6 +7,10 @@ require (
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/joho/godotenv v1.3.0
 	github.com/julienschmidt/httprouter v1.3.0
-	github.com/notduncansmith/duramap v0.0.0-20200210002654-444af415bf0d
+	github.com/kr/pretty v0.1.0 // indirect
 	github.com/notduncansmith/mutable v0.0.0-20191105072558-a13a78d07b91
+	github.com/vmihailenco/msgpack v4.0.4+incompatible
+	go.etcd.io/bbolt v1.3.6
+	google.golang.org/appengine v1.6.5 // indirect
+	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 )
@@ -0,0 +1,235 @@
+package mcache
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	mp "github.com/vmihailenco/msgpack"
+)
+
+// historySide is the side bucket holding previous versions of documents, keyed by document ID and version
+const historySide = "history"
+
+// historyKey sorts a document's versions together, in version order
+func historyKey(id string, version int64) string {
+	var bz [8]byte
+	binary.BigEndian.PutUint64(bz[:], uint64(version))
+	return historyPrefix(id) + string(bz[:])
+}
+
+func historyPrefix(id string) string {
+	return id + "\x00"
+}
+
+// sideIterator is the signature shared by docStore.forEachSide and storeTx.ForEach
+type sideIterator func(side, prefix string, f func(k string, bz []byte) error) error
+
+// readHistory returns the stored previous versions of a document and their keys, oldest first
+func readHistory(forEach sideIterator, id string) (versions []Document, keys []string, err error) {
+	err = forEach(historySide, historyPrefix(id), func(k string, bz []byte) error {
+		stored := storedDocument{}
+		if err := mp.Unmarshal(bz, &stored); err != nil {
+			return fmt.Errorf("Unable to decode version of document %v: %v", id, err)
+		}
+		versions = append(versions, stored.Doc)
+		keys = append(keys, k)
+		return nil
+	})
+	return
+}
+
+// keepHistory saves the version of a document that is being replaced at `now`, then discards any versions outside the index's history retention
+func (i *Index) keepHistory(tx *storeTx, prev Document, exists bool, now Timestamp) error {
+	settings := i.settings
+	if !exists || !settings.historyEnabled() {
+		return nil
+	}
+
+	versions, keys, err := readHistory(tx.ForEach, prev.ID)
+	if err != nil {
+		return err
+	}
+	key := historyKey(prev.ID, prev.Version)
+	if len(keys) == 0 || keys[len(keys)-1] != key {
+		bz, err := mp.Marshal(storedDocument{Doc: prev})
+		if err != nil {
+			return err
+		}
+		tx.Put(historySide, key, bz)
+		versions = append(versions, prev)
+		keys = append(keys, key)
+	}
+
+	cutoff := now - settings.HistorySeconds
+	for n := range versions {
+		if len(versions)-n <= settings.HistoryVersions {
+			break
+		}
+		replacedAt := now
+		if n+1 < len(versions) {
+			replacedAt = versions[n+1].UpdatedAt
+		}
+		if settings.HistorySeconds > 0 && replacedAt >= cutoff {
+			continue
+		}
+		tx.Remove(historySide, keys[n])
+	}
+	return nil
+}
+
+// removeHistory discards every previous version of a document
+func removeHistory(tx *storeTx, id string) error {
+	_, keys, err := readHistory(tx.ForEach, id)
+	for _, k := range keys {
+		tx.Remove(historySide, k)
+	}
+	return err
+}
+
+// exportVersion is like export, but decodes manifest bodies without the decoded manifest cache, which only holds current versions
+func (i *Index) exportVersion(d Document) (Document, error) {
+	d, err := i.decodeBody(d)
+	if err != nil {
+		return d, err
+	}
+	if !d.IsManifest() || d.Deleted || len(d.Body) == 0 || d.Body[0] != compactManifestFormat {
+		return d, nil
+	}
+	ids, err := decodeManifestBody(d.Body)
+	if err != nil {
+		return d, fmt.Errorf("Unable to decode manifest %v: %v", d.ID, err)
+	}
+	d.Body, err = json.Marshal(ids)
+	return d, err
+}
+
+// History returns every kept version of a document, oldest first and ending with the current version
+func (i *Index) History(id string) (history []Document, err error) {
+	err = i.view(func(m map[string]Document) error {
+		current, ok := m[id]
+		if !ok {
+			return fmt.Errorf("Document not found for id %v", id)
+		}
+		versions, _, err := readHistory(i.docs.forEachSide, id)
+		if err != nil {
+			return err
+		}
+		for _, d := range append(versions, current) {
+			exported, err := i.exportVersion(d)
+			if err != nil {
+				return err
+			}
+			history = append(history, exported)
+		}
+		return nil
+	})
+	return
+}
+
+// GetVersion returns a specific version of a document, if it is current or has been kept
+func (i *Index) GetVersion(id string, version int64) (doc *Document, err error) {
+	err = i.view(func(m map[string]Document) error {
+		d, ok := m[id]
+		if !ok {
+			return fmt.Errorf("Document not found for id %v", id)
+		}
+		if d.Version != version {
+			bz, err := i.docs.loadSide(historySide, historyKey(id, version))
+			if err != nil {
+				return err
+			}
+			if bz == nil {
+				return fmt.Errorf("Version %v of document %v not found", version, id)
+			}
+			stored := storedDocument{}
+			if err = mp.Unmarshal(bz, &stored); err != nil {
+				return fmt.Errorf("Unable to decode version of document %v: %v", id, err)
+			}
+			d = stored.Doc
+		}
+		exported, err := i.exportVersion(d)
+		doc = &exported
+		return err
+	})
+	return
+}
+
+// versionAsOf returns the version of a document that was current at `asOf`, if it has been kept
+func (i *Index) versionAsOf(m map[string]Document, id string, asOf Timestamp) (Document, bool, error) {
+	current, ok := m[id]
+	if !ok || current.UpdatedAt <= asOf {
+		return current, ok, nil
+	}
+	versions, _, err := readHistory(i.docs.forEachSide, id)
+	if err != nil {
+		return Document{}, false, err
+	}
+	for n := len(versions) - 1; n >= 0; n-- {
+		if versions[n].UpdatedAt <= asOf {
+			return versions[n], true, nil
+		}
+	}
+	return Document{}, false, nil
+}
+
+// QueryAsOf is like Query, but returns the documents as they were at `asOf`, resolving manifests as they were then too.
+// Documents whose version at `asOf` was not kept in the index's history are treated as if they did not exist.
+func (i *Index) QueryAsOf(manifestID string, updatedAfter Timestamp, asOf Timestamp) (results *DocSet, err error) {
+	if err = i.promoteLegacyManifests(manifestID); err != nil {
+		return
+	}
+	err = i.view(func(m map[string]Document) error {
+		var lookupErr error
+		found := map[string]Document{}
+		missing := IDSet{}
+		lookup := func(id string) (Document, bool) {
+			if d, ok := found[id]; ok {
+				return d, true
+			}
+			if _, ok := missing[id]; ok {
+				return Document{}, false
+			}
+			d, ok, err := i.versionAsOf(m, id, asOf)
+			if err != nil && lookupErr == nil {
+				lookupErr = err
+			}
+			if ok {
+				found[id] = d
+			} else {
+				missing[id] = SetEntry{}
+			}
+			return d, ok
+		}
+
+		src := manifestSource{peek: lookup, get: lookup, decode: func(d Document) (IDSet, error) {
+			return liveManifestIDs(d, i.cipher)
+		}}
+		manifests, err := resolveManifestFrom(src, manifestID, i.config.maxManifestDepth())
+		if err != nil {
+			return err
+		}
+
+		ids := NewIDSet(manifestID)
+		for _, manifest := range manifests {
+			for id := range manifest.DocumentIDs {
+				ids[id] = SetEntry{}
+			}
+		}
+
+		results = NewDocSet()
+		for id := range ids {
+			d, ok := lookup(id)
+			if !ok || d.UpdatedAt <= updatedAfter {
+				continue
+			}
+			exported, err := i.exportVersion(d)
+			if err != nil {
+				return err
+			}
+			results.Add(exported)
+		}
+		return lookupErr
+	})
+	return
+}
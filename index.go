@@ -1,43 +1,335 @@
 package mcache
 
 import (
-	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
-
-	lru "github.com/hashicorp/golang-lru"
-	du "github.com/notduncansmith/duramap"
 )
 
-// Index represents a collection of documents managed by the cache
+// Index represents a collection of documents managed by the cache.
+// Its store is opened on first use and may be closed again while idle.
 type Index struct {
-	ID    string `json:"id"`
-	docs  *du.Duramap
-	cache *lru.TwoQueueCache
+	ID         string `json:"id"`
+	path       string
+	config     Config
+	newCache   CacheFactory
+	mut        *sync.Mutex
+	released   *sync.Cond
+	docs       *docStore
+	cache      DocCache
+	refs       int
+	lastUsed   time.Time
+	closed     bool
+	warmup     *WarmupStatus
+	manifests  *manifestCache
+	membership membershipIndex
+	// legacyManifests holds the IDs of documents that may have been used as manifests before kinds existed
+	legacyManifests IDSet
+	settings        IndexSettings
+	cipher          *bodyCipher
+	expiry          *expiryQueue
+	stopExpiry      chan struct{}
+	// cursors are kept while the index's store is closed, and pendingCursors are those not stored yet
+	cursors        clientCursors
+	pendingCursors map[string]clientCursor
+	onOpen         func(*Index)
 }
 
-// NewIndex returns a new Index
-func NewIndex(id string, docs *du.Duramap, cacheSize int) (*Index, error) {
-	cache, err := lru.New2Q(cacheSize)
-	if err != nil {
-		return nil, err
+// NewIndex returns an Index with the given ID stored in the file at `path`, caching documents in a cache made by `newCache`.
+// The file is not opened until the index is used.
+func NewIndex(id string, path string, newCache CacheFactory, config Config) *Index {
+	mut := &sync.Mutex{}
+	return &Index{
+		ID:             id,
+		path:           path,
+		config:         config,
+		newCache:       newCache,
+		mut:            mut,
+		released:       sync.NewCond(mut),
+		manifests:      newManifestCache(),
+		cursors:        clientCursors{},
+		pendingCursors: map[string]clientCursor{},
+	}
+}
+
+// Close waits for any in-progress operations to finish and closes the index's store. A closed index cannot be reopened.
+func (i *Index) Close() error {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	i.closed = true
+	for i.refs > 0 {
+		i.released.Wait()
+	}
+	return i.unsafeCloseStore()
+}
+
+// IsOpen returns true if the index's store is currently open
+func (i *Index) IsOpen() bool {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	return i.docs != nil
+}
+
+// use opens the index's store if necessary and calls `f`, preventing the store from being closed until `f` returns
+func (i *Index) use(f func() error) error {
+	if err := i.acquire(); err != nil {
+		return err
 	}
+	defer i.release()
+	return f()
+}
 
-	return &Index{id, docs, cache}, nil
+// view is like `use`, but calls `f` with the store's map while holding its read lock, so `f` sees a consistent snapshot of the store and cache
+func (i *Index) view(f func(m map[string]Document) error) error {
+	return i.use(func() (err error) {
+		i.docs.DoWithMap(func(m map[string]Document) {
+			err = f(m)
+		})
+		return
+	})
+}
+
+func (i *Index) acquire() error {
+	i.mut.Lock()
+	if i.closed {
+		i.mut.Unlock()
+		return fmt.Errorf("Index %v is closed", i.ID)
+	}
+
+	opened := false
+	if i.docs == nil {
+		cache, err := i.newCache(i.ID)
+		if err != nil {
+			i.mut.Unlock()
+			return fmt.Errorf("Failed to create cache: %v", err)
+		}
+		docs, err := openDocStore(i.path, i.ID)
+		if err != nil {
+			i.mut.Unlock()
+			return fmt.Errorf("Failed to open store: %v", err)
+		}
+		if err = migrateDocumentKinds(docs); err != nil {
+			docs.Close()
+			i.mut.Unlock()
+			return fmt.Errorf("Failed to migrate document kinds: %v", err)
+		}
+		if err = migrateDocumentBodies(docs); err != nil {
+			docs.Close()
+			i.mut.Unlock()
+			return fmt.Errorf("Failed to migrate document bodies: %v", err)
+		}
+		legacyManifests, err := loadLegacyManifests(docs)
+		if err != nil {
+			docs.Close()
+			i.mut.Unlock()
+			return fmt.Errorf("Failed to load legacy manifests: %v", err)
+		}
+		cipher, err := loadDataKey(docs, i.config)
+		if err != nil {
+			docs.Close()
+			i.mut.Unlock()
+			return fmt.Errorf("Failed to load data key: %v", err)
+		}
+		membership, err := buildMembershipIndex(docs, cipher)
+		if err != nil {
+			docs.Close()
+			i.mut.Unlock()
+			return fmt.Errorf("Failed to index manifest members: %v", err)
+		}
+		settings, err := loadSettings(docs)
+		if err != nil {
+			docs.Close()
+			i.mut.Unlock()
+			return fmt.Errorf("Failed to load settings: %v", err)
+		}
+		if err = i.loadCursors(docs); err != nil {
+			docs.Close()
+			i.mut.Unlock()
+			return fmt.Errorf("Failed to load cursors: %v", err)
+		}
+		i.docs = docs
+		i.membership = membership
+		i.legacyManifests = legacyManifests
+		i.settings = settings
+		i.cipher = cipher
+		i.expiry = buildExpiryQueue(docs)
+		i.stopExpiry = make(chan struct{})
+		go i.expireDocuments(i.expiry, i.stopExpiry)
+		i.cache = cache
+		if err = i.encryptExisting(); err != nil {
+			i.unsafeCloseStore()
+			i.mut.Unlock()
+			return fmt.Errorf("Failed to encrypt documents: %v", err)
+		}
+		opened = true
+	}
+
+	i.refs++
+	i.lastUsed = time.Now()
+	onOpen := i.onOpen
+	i.mut.Unlock()
+
+	if opened && onOpen != nil {
+		onOpen(i)
+	}
+	return nil
+}
+
+// acquireOpen is like acquire, but fails instead of opening the store, so background work does not keep reopening an index
+func (i *Index) acquireOpen() bool {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	if i.closed || i.docs == nil {
+		return false
+	}
+	i.refs++
+	return true
+}
+
+func (i *Index) release() {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	i.refs--
+	i.lastUsed = time.Now()
+	if i.refs == 0 {
+		i.released.Broadcast()
+	}
+}
+
+// closeIfIdle closes the index's store if it is open, not in use, and was last used before `cutoff`
+func (i *Index) closeIfIdle(cutoff time.Time) bool {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	if i.docs == nil || i.refs > 0 || i.lastUsed.After(cutoff) {
+		return false
+	}
+	if err := i.unsafeCloseStore(); err != nil {
+		i.config.logf("Error closing idle index %v: %v\n", i.ID, err)
+	}
+	return true
+}
+
+func (i *Index) lastUsedAt() time.Time {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	return i.lastUsed
+}
+
+func (i *Index) unsafeCloseStore() error {
+	if i.docs == nil {
+		return nil
+	}
+	if err := i.storePendingCursors(); err != nil {
+		i.config.logf("Error storing cursors of index %v: %v\n", i.ID, err)
+	}
+	err := i.docs.Close()
+	i.cache.Purge()
+	i.manifests.purge()
+	i.docs = nil
+	i.cache = nil
+	i.membership = nil
+	i.legacyManifests = nil
+	i.settings = IndexSettings{}
+	i.cipher = nil
+	close(i.stopExpiry)
+	i.expiry = nil
+	i.warmup = nil
+	return err
 }
 
 // Update updates the index documents with the latest versions
 func (i *Index) Update(docs *DocSet) (*DocSet, error) {
+	return i.update(func(tx *storeTx) (*DocSet, error) {
+		return docs, nil
+	})
+}
+
+// update writes the documents returned by `f`, which is called within the write transaction so it can base them on the stored documents
+func (i *Index) update(f func(tx *storeTx) (*DocSet, error)) (*DocSet, error) {
+	return i.write(f, false)
+}
+
+// write is like update, but if `preserve` is true, documents keep the UpdatedAt and Version they are given (if they are set) instead of being restamped
+func (i *Index) write(f func(tx *storeTx) (*DocSet, error), preserve bool) (*DocSet, error) {
 	updated := NewDocSet()
+	written := []Document{}
+	changes := []membershipChange{}
+	settled := []string{}
 	now := time.Now().Unix()
-	err := i.docs.UpdateMap(func(tx *du.Tx) error {
-		for _, d := range docs.Docs {
-			d.UpdatedAt = now
-			updated.Add(d)
-			i.cache.Add(d.ID, d)
-			tx.Set(d.ID, d)
-		}
-		return nil
+	err := i.use(func() error {
+		return i.docs.UpdateMap(func(tx *storeTx) error {
+			docs, err := f(tx)
+			if err != nil {
+				return err
+			}
+			for _, doc := range docs.Docs {
+				// documents read back from the store are rewritten with their bodies decompressed, then compressed again below
+				d, err := i.decodeBody(doc)
+				if err != nil {
+					return err
+				}
+				prev, exists := tx.Get(d.ID)
+				if err := prepareDocument(&d, prev, exists); err != nil {
+					return err
+				}
+				if err := i.checkBlob(&d); err != nil {
+					return err
+				}
+				writtenAt := now
+				if preserve && d.UpdatedAt > 0 {
+					writtenAt = d.UpdatedAt
+				}
+				d.UpdatedAt = writtenAt
+				if !preserve || d.Version <= 0 {
+					d.Version = prev.Version + 1
+				} else if exists && d.Version <= prev.Version {
+					return fmt.Errorf("Invalid document %v: version %v is not newer than the stored version %v", d.ID, d.Version, prev.Version)
+				}
+				i.applyExpiry(&d, writtenAt)
+
+				stored, err := i.encodeDocument(d)
+				if err != nil {
+					return err
+				}
+				d.Hash = stored.Hash
+				updated.Add(d)
+				written = append(written, stored)
+				tx.Set(d.ID, stored)
+				if _, ok := i.legacyManifests[d.ID]; ok {
+					// a document written since kinds exist has the kind it was written with
+					tx.Remove(legacyManifestsSide, d.ID)
+					settled = append(settled, d.ID)
+				}
+
+				if change, err := diffMembership(prev, stored, i.cipher); err != nil {
+					return err
+				} else if change != nil {
+					changes = append(changes, *change)
+				}
+				if err := i.keepForRestore(tx, prev, exists, stored); err != nil {
+					return err
+				}
+				if err := i.keepHistory(tx, prev, exists, writtenAt); err != nil {
+					return err
+				}
+			}
+			tx.OnCommit(func() {
+				for _, d := range written {
+					i.cache.Add(d)
+					i.manifests.remove(d.ID)
+					if d.ExpiresAt > 0 && !d.Deleted {
+						i.expiry.push(expiryItem{d.ID, d.ExpiresAt, d.ExpiresAt})
+					}
+				}
+				for _, c := range changes {
+					i.membership.update(c.manifestID, c.before, c.after)
+				}
+				for _, id := range settled {
+					delete(i.legacyManifests, id)
+				}
+			})
+			return nil
+		})
 	})
 
 	if err != nil {
@@ -47,20 +339,134 @@ func (i *Index) Update(docs *DocSet) (*DocSet, error) {
 	return updated, nil
 }
 
+// prepareDocument validates a document that is about to replace `prev` (if it `exists`), defaulting its kind and clearing query-only fields.
+// Tombstones and documents written without a kind over a live manifest keep the kind they replace.
+// Manifests must have a valid body and can only be replaced by manifests or tombstones.
+func prepareDocument(d *Document, prev Document, exists bool) error {
+	d.Delta, d.BaseVersion = nil, 0
+	if exists && (d.Deleted || (d.Kind == "" && prev.IsManifest() && !prev.Deleted)) {
+		d.Kind = prev.Kind
+	}
+	if d.Kind == "" {
+		d.Kind = DocumentKind
+	}
+
+	if err := validateMetadata(d); err != nil {
+		return err
+	}
+
+	switch d.Kind {
+	case DocumentKind:
+		if exists && prev.IsManifest() && !prev.Deleted && !d.Deleted {
+			return fmt.Errorf("Invalid document %v: cannot replace a manifest with a document", d.ID)
+		}
+	case ManifestKind:
+		if _, err := decodeManifestBody(d.Body); !d.Deleted && err != nil {
+			return fmt.Errorf("Invalid manifest %v: body must be a JSON object of document IDs", d.ID)
+		}
+	default:
+		return fmt.Errorf("Invalid document %v: unknown kind %v", d.ID, d.Kind)
+	}
+
+	return nil
+}
+
+// encodeDocument returns the form a document is stored in, with its body hashed and then encoded
+func (i *Index) encodeDocument(d Document) (Document, error) {
+	stored, err := storedForm(d)
+	if err != nil {
+		return stored, err
+	}
+	stored.Hash = ""
+	if !stored.Deleted {
+		stored.Hash = i.hashBody(stored.Body)
+	}
+	return i.encodeBody(stored)
+}
+
+// storedForm returns a document as it is stored in the index, with manifest bodies in compact form
+func storedForm(d Document) (Document, error) {
+	if !d.IsManifest() || d.Deleted {
+		return d, nil
+	}
+	ids, err := decodeManifestBody(d.Body)
+	if err != nil {
+		return d, err
+	}
+	d.Body = encodeCompactManifest(ids)
+	return d, nil
+}
+
+// export returns a stored document as it is presented to clients, with manifest bodies in JSON form.
+// A document that cannot be decoded is logged and returned as an error, rather than sent without its body.
+// A document whose expiry has passed is returned as a tombstone.
+func (i *Index) export(d Document) (Document, error) {
+	// the index may not have been open when the document expired, so it is hidden until the expiry worker catches up
+	if isExpired(d, time.Now().Unix()) {
+		return expiredTombstone(d), nil
+	}
+	if d.IsManifest() && !d.Deleted && (d.Encoding != "" || (len(d.Body) > 0 && d.Body[0] == compactManifestFormat)) {
+		// encrypted manifests are decrypted by the decoded manifest cache, so cached manifests are not decrypted again
+		decoded, err := i.manifests.get(d, i.cipher)
+		if err != nil {
+			i.config.logf("Unable to export manifest %v of index %v: %v\n", d.ID, i.ID, err)
+			return d, fmt.Errorf("Unable to decode manifest %v: %v", d.ID, err)
+		}
+		d.Body = decoded.json
+		d.Encoding = ""
+		return d, nil
+	}
+	decoded, err := i.decodeBody(d)
+	if err != nil {
+		i.config.logf("Unable to export document %v of index %v: %v\n", d.ID, i.ID, err)
+		return d, err
+	}
+	return decoded, nil
+}
+
+func (i *Index) exportDocSet(docs *DocSet) (*DocSet, error) {
+	exported := NewDocSet()
+	for _, d := range docs.Docs {
+		e, err := i.export(d)
+		if err != nil {
+			return nil, err
+		}
+		exported.Add(e)
+	}
+	return exported, nil
+}
+
+// migrateDocumentKinds makes documents stored before kinds existed plain documents.
+// Those whose body looks like a manifest are recorded as legacy manifests, which become manifests when they are first queried as one.
+func migrateDocumentKinds(docs *docStore) error {
+	return docs.UpdateMap(func(tx *storeTx) error {
+		for id, d := range tx.m {
+			if d.Kind != "" {
+				continue
+			}
+			d.Kind = DocumentKind
+			if !d.Deleted && isLegacyManifestBody(d.Body) {
+				tx.Put(legacyManifestsSide, id, []byte{})
+			}
+			tx.Set(id, d)
+		}
+		return nil
+	})
+}
+
 // Get gets the index document with the given ID
 func (i *Index) Get(id string) (doc *Document, err error) {
-	i.docs.DoWithMap(func(m du.GenericMap) {
-		d := m[id]
-		if d == nil {
-			err = fmt.Errorf("Document not found for id %v", id)
-			return
-		}
-		stored, ok := d.(Document)
+	err = i.view(func(m map[string]Document) error {
+		stored, ok := m[id]
 		if !ok {
-			err = fmt.Errorf("Unable to decode document %+v", d)
-			return
+			return fmt.Errorf("Document not found for id %v", id)
+		}
+		exported, err := i.export(stored)
+		if err != nil {
+			return err
 		}
-		doc = &stored
+		doc = &exported
+		return nil
 	})
 	return
 }
@@ -68,15 +474,15 @@ func (i *Index) Get(id string) (doc *Document, err error) {
 // GetAll gets all the index documents
 func (i *Index) GetAll() (docs *DocSet, err error) {
 	docs = NewDocSet()
-	i.docs.DoWithMap(func(m du.GenericMap) {
+	err = i.view(func(m map[string]Document) error {
 		for _, v := range m {
-			stored, ok := v.(Document)
-			if !ok {
-				fmt.Printf("Unable to decode document %+v", v)
-				continue
+			exported, err := i.export(v)
+			if err != nil {
+				return err
 			}
-			docs.Add(stored)
+			docs.Add(exported)
 		}
+		return nil
 	})
 	return
 }
@@ -93,93 +499,338 @@ func (i *Index) SoftDelete(ids IDSet) (*DocSet, error) {
 }
 
 // GetManifest returns a manifest document
-func (i *Index) GetManifest(id string) (*Manifest, error) {
-	docs, err := i.LoadDocuments(NewIDSet(id), 0)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to load manifest %v: %v", id, err)
+func (i *Index) GetManifest(id string) (manifest *Manifest, err error) {
+	if err = i.promoteLegacyManifests(id); err != nil {
+		return
 	}
-	if docs == nil || len(docs.Docs) == 0 {
-		return nil, fmt.Errorf("Unable to load manifest %v: not found", id)
+	err = i.view(func(m map[string]Document) (err error) {
+		manifest, err = i.getManifest(m, id)
+		if err == nil {
+			manifest.DocumentIDs = copyIDSet(manifest.DocumentIDs)
+		}
+		return
+	})
+	return
+}
+
+// getManifest returns a manifest whose DocumentIDs are shared with the decoded manifest cache and must not be modified
+func (i *Index) getManifest(m map[string]Document, id string) (*Manifest, error) {
+	return loadManifest(i.currentManifests(m), id)
+}
+
+// resolveManifest returns the manifest with the given ID followed by every manifest it includes, directly or through other manifests
+func (i *Index) resolveManifest(m map[string]Document, id string) ([]*Manifest, error) {
+	return resolveManifestFrom(i.currentManifests(m), id, i.config.maxManifestDepth())
+}
+
+// manifestSource looks up the documents used to resolve manifests
+type manifestSource struct {
+	// peek returns a document without caching it
+	peek func(id string) (Document, bool)
+	// get returns a manifest document, caching it if appropriate
+	get func(id string) (Document, bool)
+	// decode returns the IDs in a manifest's body, which must not be modified
+	decode func(d Document) (IDSet, error)
+}
+
+// currentManifests returns a manifestSource that reads the latest documents through the index's caches
+func (i *Index) currentManifests(m map[string]Document) manifestSource {
+	return manifestSource{
+		peek: func(id string) (Document, bool) {
+			d, ok := m[id]
+			return d, ok
+		},
+		get: func(id string) (Document, bool) {
+			d, ok := i.loadDocuments(m, NewIDSet(id), 0).Docs[id]
+			return d, ok
+		},
+		decode: func(d Document) (IDSet, error) {
+			decoded, err := i.manifests.get(d, i.cipher)
+			if err != nil {
+				return nil, err
+			}
+			return decoded.ids, nil
+		},
 	}
+}
 
-	manifestDocument := docs.Docs[id]
-	docIds := IDSet{}
+func loadManifest(src manifestSource, id string) (*Manifest, error) {
+	manifestDocument, ok := src.get(id)
+	if !ok {
+		return nil, fmt.Errorf("Unable to load manifest %v: not found", id)
+	}
+	if !manifestDocument.IsManifest() {
+		return nil, fmt.Errorf("Unable to load manifest %v: document is not a manifest", id)
+	}
+	if manifestDocument.Deleted {
+		return nil, fmt.Errorf("Unable to load manifest %v: deleted", id)
+	}
 
-	if err = json.Unmarshal(manifestDocument.Body, &docIds); err != nil {
+	ids, err := src.decode(manifestDocument)
+	if err != nil {
 		return nil, fmt.Errorf("Unable to decode manifest body: %v", err)
 	}
 
-	m := Manifest{ID: id, UpdatedAt: manifestDocument.UpdatedAt, DocumentIDs: docIds}
-	return &m, nil
+	manifest := Manifest{ID: id, UpdatedAt: manifestDocument.UpdatedAt, DocumentIDs: ids}
+	return &manifest, nil
 }
 
-// Query returns any documents matching the manifest with the given id that were updated after the given timestamp
-func (i *Index) Query(manifestID string, updatedAfter Timestamp) (*DocSet, error) {
-	m, err := i.GetManifest(manifestID)
+// resolveManifestFrom returns the manifest with the given ID followed by every manifest it includes, directly or through other manifests.
+// A manifest includes another when one of its document IDs is a manifest's ID. Each manifest is visited once, so cycles are ignored.
+func resolveManifestFrom(src manifestSource, id string, maxDepth int) ([]*Manifest, error) {
+	root, err := loadManifest(src, id)
 	if err != nil {
 		return nil, err
 	}
-	m.DocumentIDs[manifestID] = SetEntry{}
-	return i.LoadDocuments(m.DocumentIDs, updatedAfter)
+
+	visited := NewIDSet(id)
+	manifests := []*Manifest{root}
+	level := manifests
+	for depth := 0; len(level) > 0; depth++ {
+		next := []*Manifest{}
+		for _, manifest := range level {
+			for docID := range manifest.DocumentIDs {
+				d, ok := src.peek(docID)
+				if !ok || !d.IsManifest() || d.Deleted {
+					continue
+				}
+				if _, seen := visited[docID]; seen {
+					continue
+				}
+				if depth >= maxDepth {
+					return nil, fmt.Errorf("Unable to load manifest %v: manifests are nested more than %v deep", id, maxDepth)
+				}
+				visited[docID] = SetEntry{}
+				included, err := loadManifest(src, docID)
+				if err != nil {
+					return nil, err
+				}
+				next = append(next, included)
+			}
+		}
+		manifests = append(manifests, next...)
+		level = next
+	}
+
+	return manifests, nil
+}
+
+// Manifests returns every manifest in the index that has not been deleted
+func (i *Index) Manifests() (manifests []*Manifest, err error) {
+	manifests = []*Manifest{}
+	err = i.view(func(m map[string]Document) error {
+		for id, d := range m {
+			if !d.IsManifest() || d.Deleted {
+				continue
+			}
+			decoded, err := i.manifests.get(d, i.cipher)
+			if err != nil {
+				return fmt.Errorf("Unable to decode manifest %v: %v", id, err)
+			}
+			manifests = append(manifests, &Manifest{ID: id, UpdatedAt: d.UpdatedAt, DocumentIDs: copyIDSet(decoded.ids)})
+		}
+		return nil
+	})
+	return
+}
+
+// Query returns any documents matching the manifest with the given id that were updated after the given timestamp.
+// Documents in manifests that the manifest includes are matched too, and any included manifests that changed are returned as well.
+func (i *Index) Query(manifestID string, updatedAfter Timestamp) (*DocSet, error) {
+	return i.QueryAs("", manifestID, updatedAfter)
+}
+
+// QueryAs is like Query, but records the query's cursor for the client with the given ID, so tombstones the client has not seen are kept
+func (i *Index) QueryAs(clientID string, manifestID string, updatedAfter Timestamp) (*DocSet, error) {
+	return i.QueryKnownAs(clientID, manifestID, updatedAfter, nil)
+}
+
+// QueryKnownAs is like QueryAs, but `known` maps the IDs of documents the client already holds to their versions, as in ManifestQuery.Known
+func (i *Index) QueryKnownAs(clientID string, manifestID string, updatedAfter Timestamp, known map[string]int64) (results *DocSet, err error) {
+	if err = validateClientID(clientID); err != nil {
+		return
+	}
+	if err = i.promoteLegacyManifests(manifestID); err != nil {
+		return
+	}
+	queried := IDSet{}
+	err = i.view(func(m map[string]Document) error {
+		manifests, err := i.resolveManifest(m, manifestID)
+		if err != nil {
+			return err
+		}
+		results = i.loadDocuments(m, NewIDSet(manifestID), updatedAfter)
+		for _, manifest := range manifests {
+			results.Merge(i.loadDocuments(m, manifest.DocumentIDs, updatedAfter))
+			queried[manifest.ID] = SetEntry{}
+		}
+		if results, err = i.exportDocSet(results); err != nil {
+			return err
+		}
+		i.encodeDeltas(results, known)
+		return nil
+	})
+	if err == nil {
+		i.recordCursors(clientID, queried, updatedAfter)
+	}
+	return
+}
+
+// QueryMany runs several manifest queries in one pass over the index, returning each matching document once along with a cursor for each manifest.
+// A manifest's cursor is the latest UpdatedAt among its returned documents, or its query's `After` if none were returned.
+func (i *Index) QueryMany(queries []ManifestQuery) (*QueryManyResult, error) {
+	return i.QueryManyAs("", queries)
+}
+
+// QueryManyAs is like QueryMany, but records the queries' cursors for the client with the given ID (see QueryAs)
+func (i *Index) QueryManyAs(clientID string, queries []ManifestQuery) (result *QueryManyResult, err error) {
+	if err = validateClientID(clientID); err != nil {
+		return
+	}
+	manifestIDs := make([]string, len(queries))
+	for n, q := range queries {
+		manifestIDs[n] = q.ManifestID
+	}
+	if err = i.promoteLegacyManifests(manifestIDs...); err != nil {
+		return
+	}
+	resolved := make([][]*Manifest, len(queries))
+	err = i.view(func(m map[string]Document) error {
+		since := map[string]Timestamp{}
+		for n, q := range queries {
+			manifests, err := i.resolveManifest(m, q.ManifestID)
+			if err != nil {
+				return err
+			}
+			resolved[n] = manifests
+			addThreshold(since, q.ManifestID, q.After)
+			for _, manifest := range manifests {
+				for id := range manifest.DocumentIDs {
+					addThreshold(since, id, q.After)
+				}
+			}
+		}
+
+		docs := i.loadDocumentsSince(m, since)
+		cursors := map[string]Timestamp{}
+		for n, q := range queries {
+			cursor := q.After
+			if d, ok := docs.Docs[q.ManifestID]; ok && d.UpdatedAt > cursor {
+				cursor = d.UpdatedAt
+			}
+			for _, manifest := range resolved[n] {
+				for id := range manifest.DocumentIDs {
+					if d, ok := docs.Docs[id]; ok && d.UpdatedAt > cursor {
+						cursor = d.UpdatedAt
+					}
+				}
+			}
+			cursors[q.ManifestID] = cursor
+		}
+
+		exported, err := i.exportDocSet(docs)
+		if err != nil {
+			return err
+		}
+		result = &QueryManyResult{exported, cursors}
+		for _, q := range queries {
+			i.encodeDeltas(result.DocSet, q.Known)
+		}
+		return nil
+	})
+	if err == nil {
+		for n, q := range queries {
+			queried := IDSet{}
+			for _, manifest := range resolved[n] {
+				queried[manifest.ID] = SetEntry{}
+			}
+			i.recordCursors(clientID, queried, q.After)
+		}
+	}
+	return
+}
+
+// addThreshold records that a document is wanted if it was updated after `after`, keeping the earliest threshold
+func addThreshold(since map[string]Timestamp, id string, after Timestamp) {
+	if existing, ok := since[id]; !ok || after < existing {
+		since[id] = after
+	}
 }
 
 // LoadDocuments will, for a given set of document IDs, query the LRU cache for the latest matching versions and fetch the rest from the store
-func (i *Index) LoadDocuments(docIDs IDSet, updatedAfter Timestamp) (*DocSet, error) {
+func (i *Index) LoadDocuments(docIDs IDSet, updatedAfter Timestamp) (results *DocSet, err error) {
+	err = i.view(func(m map[string]Document) error {
+		results, err = i.exportDocSet(i.loadDocuments(m, docIDs, updatedAfter))
+		return err
+	})
+	return
+}
+
+// loadDocuments reads documents from the cache or the store's map `m`, adding any it reads from the map to the cache.
+// It must be called while holding the store's lock, so the cache and map cannot change in between.
+func (i *Index) loadDocuments(m map[string]Document, docIDs IDSet, updatedAfter Timestamp) *DocSet {
 	results := NewDocSet()
-	uncachedIds := IDSet{}
 
 	for k := range docIDs {
-		if !i.cache.Contains(k) {
-			uncachedIds[k] = SetEntry{}
-			continue
-		}
-		cached, ok := i.cache.Get(k)
+		doc, ok := i.cache.Get(k)
 		if !ok {
-			panic("Failed to get doc from cache")
-		}
-		doc, ok := cached.(Document)
-		if !ok {
-			panic("Non-document (id: " + k + ") found in store")
+			doc, ok = m[k]
+			if !ok {
+				continue
+			}
+			i.cache.Add(doc)
 		}
 		if doc.UpdatedAt > updatedAfter {
 			results.Add(doc)
 		}
 	}
 
-	i.docs.DoWithMap(func(m du.GenericMap) {
-		var doc Document
-		var ok bool
-		for k := range uncachedIds {
-			doc, ok = m[k].(Document)
+	return results
+}
+
+// loadDocumentsSince is like loadDocuments, but each document has its own threshold
+func (i *Index) loadDocumentsSince(m map[string]Document, since map[string]Timestamp) *DocSet {
+	results := NewDocSet()
+
+	for k, updatedAfter := range since {
+		doc, ok := i.cache.Get(k)
+		if !ok {
+			doc, ok = m[k]
 			if !ok {
-				panic("Non-document (id: " + k + ") found in store")
-			}
-			if doc.UpdatedAt > updatedAfter {
-				results.Add(doc)
-				i.cache.Add(k, doc)
+				continue
 			}
+			i.cache.Add(doc)
 		}
-	})
+		if doc.UpdatedAt > updatedAfter {
+			results.Add(doc)
+		}
+	}
 
-	return results, nil
+	return results
 }
 
 // Keys returns all the keys in an index
-func (i *Index) Keys() IDSet {
-	keys := IDSet{}
-	i.docs.DoWithMap(func(m du.GenericMap) {
+func (i *Index) Keys() (keys IDSet, err error) {
+	keys = IDSet{}
+	err = i.view(func(m map[string]Document) error {
 		for k := range m {
 			keys[k] = SetEntry{}
 		}
+		return nil
 	})
-	return keys
+	return
 }
 
-// LRUKeys returns all the keys in an index's LRU cache
+// LRUKeys returns all the keys in an index's LRU cache, which is empty while the index is closed
 func (i *Index) LRUKeys() IDSet {
+	i.mut.Lock()
+	defer i.mut.Unlock()
 	keys := IDSet{}
+	if i.cache == nil {
+		return keys
+	}
 	for _, k := range i.cache.Keys() {
-		keys[k.(string)] = SetEntry{}
+		keys[k] = SetEntry{}
 	}
 	return keys
 }
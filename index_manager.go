@@ -5,58 +5,78 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
-	du "github.com/notduncansmith/duramap"
 	"github.com/notduncansmith/mutable"
 )
 
 const indexFilenamePrefix = "mcache-index-"
 const indexFilenameSuffix = ".db"
 
-// IndexManager manages a collection of Indexes
+// IndexManager manages a collection of Indexes, opening them on demand and closing them when idle
 type IndexManager struct {
 	*mutable.RW
-	path          string
-	maxIndexCount int
-	maxIndexSize  int
-	lruCacheSize  int
-	Indexes       map[string]*Index
+	path           string
+	maxIndexCount  int
+	maxIndexSize   int
+	newCache       CacheFactory
+	config         Config
+	maxOpenIndexes int
+	idleTimeout    time.Duration
+	warmCache      bool
+	Indexes        map[string]*Index
+	open           map[string]*Index
+	warmQueue      chan *Index
+	done           chan struct{}
 }
 
 // NewIndexManager initializes an IndexManager at the given path
-func NewIndexManager(config Config) *IndexManager {
-	return &IndexManager{
-		RW:            mutable.NewRW("IndexManager:" + config.DataDir),
-		path:          config.DataDir,
-		maxIndexCount: config.MaxIndexCount,
-		maxIndexSize:  config.MaxIndexSize,
-		lruCacheSize:  config.LRUCacheSize,
-		Indexes:       map[string]*Index{},
+func NewIndexManager(config Config) (*IndexManager, error) {
+	newCache, err := NewCacheFactory(config)
+	if err != nil {
+		return nil, err
 	}
-}
-
-// Open creates or returns an index with the given id
-func (m *IndexManager) Open(id string) (*Index, error) {
-	i := m.GetIndex(id)
-	if i != nil {
-		return i, nil
+	if err = validateMasterKeys(config); err != nil {
+		return nil, err
 	}
 
-	docs, err := du.NewDuramap(filepath.Join(m.path, indexFilenamePrefix+id+indexFilenameSuffix), id, nil)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to open Duramap: %v", err)
+	m := &IndexManager{
+		RW:             mutable.NewRW("IndexManager:" + config.DataDir),
+		path:           config.DataDir,
+		config:         config,
+		maxIndexCount:  config.MaxIndexCount,
+		maxIndexSize:   config.MaxIndexSize,
+		newCache:       newCache,
+		maxOpenIndexes: config.MaxOpenIndexes,
+		idleTimeout:    config.IndexIdleTimeout,
+		warmCache:      config.WarmCache,
+		Indexes:        map[string]*Index{},
+		open:           map[string]*Index{},
+		warmQueue:      make(chan *Index, warmQueueSize),
+		done:           make(chan struct{}),
 	}
 
-	i, err = NewIndex(id, docs, m.lruCacheSize)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to initialize index: %v", err)
+	if m.idleTimeout > 0 {
+		go m.closeIdleIndexes()
+	}
+	if m.warmCache {
+		go m.warmIndexes()
+	}
+	if config.CompactionInterval > 0 {
+		go m.compactIndexes()
 	}
 
-	m.DoWithRWLock(func() {
-		m.Indexes[id] = i
-	})
+	return m, nil
+}
 
+// Open creates or returns an index with the given id, creating its data file if it does not exist
+func (m *IndexManager) Open(id string) (*Index, error) {
+	i := m.register(id)
+	if err := i.use(func() error { return nil }); err != nil {
+		return nil, fmt.Errorf("Failed to initialize index: %v", err)
+	}
 	return i, nil
 }
 
@@ -73,35 +93,170 @@ func (m *IndexManager) GetIndex(id string) *Index {
 	return nil
 }
 
-// Scan will open any indexes whose data files are in the configured directory
+// OpenCount returns the number of indexes whose stores are currently open
+func (m *IndexManager) OpenCount() int {
+	return m.WithRLock(func() interface{} {
+		return len(m.open)
+	}).(int)
+}
+
+// register returns the index with the given id, adding an unopened one if it is not known yet
+func (m *IndexManager) register(id string) *Index {
+	return m.WithRWLock(func() interface{} {
+		if i := m.Indexes[id]; i != nil {
+			return i
+		}
+		i := NewIndex(id, filepath.Join(m.path, indexFilenamePrefix+id+indexFilenameSuffix), m.newCache, m.config)
+		i.onOpen = m.indexOpened
+		m.Indexes[id] = i
+		return i
+	}).(*Index)
+}
+
+// indexOpened tracks a newly-opened index, queues it for warm-up if enabled, and closes the least recently used idle indexes if too many are open
+func (m *IndexManager) indexOpened(opened *Index) {
+	if m.warmCache {
+		m.queueWarmup(opened)
+	}
+
+	candidates := m.WithRWLock(func() interface{} {
+		m.open[opened.ID] = opened
+		if m.maxOpenIndexes <= 0 || len(m.open) <= m.maxOpenIndexes {
+			return []*Index{}
+		}
+		candidates := make([]*Index, 0, len(m.open)-1)
+		for _, i := range m.open {
+			if i != opened {
+				candidates = append(candidates, i)
+			}
+		}
+		return candidates
+	}).([]*Index)
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	lastUsed := map[*Index]time.Time{}
+	for _, i := range candidates {
+		lastUsed[i] = i.lastUsedAt()
+	}
+	sort.Slice(candidates, func(a, b int) bool {
+		return lastUsed[candidates[a]].Before(lastUsed[candidates[b]])
+	})
+
+	excess := len(candidates) + 1 - m.maxOpenIndexes
+	now := time.Now()
+	for _, i := range candidates {
+		if excess <= 0 {
+			return
+		}
+		if i.closeIfIdle(now) {
+			m.indexClosed(i)
+			excess--
+		}
+	}
+
+	m.config.logf("Open index limit (%v) exceeded by %v indexes that are in use\n", m.maxOpenIndexes, excess)
+}
+
+func (m *IndexManager) indexClosed(i *Index) {
+	m.DoWithRWLock(func() {
+		if m.open[i.ID] == i {
+			delete(m.open, i.ID)
+		}
+	})
+}
+
+// closeIdleIndexes periodically closes indexes that have not been used within the idle timeout
+func (m *IndexManager) closeIdleIndexes() {
+	interval := m.idleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			open := m.WithRLock(func() interface{} {
+				open := make([]*Index, 0, len(m.open))
+				for _, i := range m.open {
+					open = append(open, i)
+				}
+				return open
+			}).([]*Index)
+
+			cutoff := now.Add(-m.idleTimeout)
+			for _, i := range open {
+				if i.closeIfIdle(cutoff) {
+					m.indexClosed(i)
+				}
+			}
+		}
+	}
+}
+
+// Scan will register any indexes whose data files are in the configured directory, to be opened when first used
 func (m *IndexManager) Scan() error {
 	_, err := os.Stat(m.path)
 	if err != nil {
-		fmt.Printf("Creating %v\n", m.path)
+		m.config.logf("Creating %v\n", m.path)
 		if err = os.MkdirAll(m.path, 0700); err != nil {
 			return fmt.Errorf("File or directory %v cannot be opened (%v)", m.path, err.Error())
 		}
 	}
 
 	files, _ := ioutil.ReadDir(m.path)
-	fmt.Printf("Scanned path %v, found %v files\n", m.path, len(files))
+	m.config.logf("Scanned path %v, found %v files\n", m.path, len(files))
 	if len(files) == 0 {
 		return nil
 	}
 
-	for i, file := range files {
+	indexFiles := []os.FileInfo{}
+	for _, file := range files {
 		if !strings.HasPrefix(file.Name(), indexFilenamePrefix) {
-			fmt.Printf("Skipping non-index file %v\n", file.Name())
+			m.config.logf("Skipping non-index file %v\n", file.Name())
 			continue
 		}
-		fmt.Printf("Loading index #%v from %v\n", i, file.Name())
-		_, err := m.Open(indexIDFromFilename(file.Name()))
-		if err != nil {
-			return fmt.Errorf("Error loading index #%v from %v: %v", i, file.Name(), err)
-		}
+		m.register(indexIDFromFilename(file.Name()))
+		indexFiles = append(indexFiles, file)
 	}
 
-	return err
+	m.config.logf("Found %v indexes\n", m.WithRLock(func() interface{} { return len(m.Indexes) }))
+	if m.warmCache {
+		go m.warmRecentIndexes(indexFiles)
+	}
+	return nil
+}
+
+// Close stops closing idle indexes, then closes every index and forgets them
+func (m *IndexManager) Close() error {
+	indexes := m.WithRWLock(func() interface{} {
+		select {
+		case <-m.done:
+		default:
+			close(m.done)
+		}
+		indexes := m.Indexes
+		m.Indexes = map[string]*Index{}
+		m.open = map[string]*Index{}
+		return indexes
+	}).(map[string]*Index)
+
+	var firstErr error
+	for id, i := range indexes {
+		if err := i.Close(); err != nil {
+			m.config.logf("Error closing index %v: %v\n", id, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
 }
 
 func indexIDFromFilename(name string) string {
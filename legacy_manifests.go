@@ -0,0 +1,82 @@
+package mcache
+
+// legacyManifestsSide is the side bucket holding the IDs of documents stored before kinds existed whose bodies look like manifests.
+// They are stored as plain documents, since their bodies may just be JSON objects, and only become manifests once they are queried as one.
+const legacyManifestsSide = "legacymanifests"
+
+func loadLegacyManifests(docs *docStore) (IDSet, error) {
+	ids := IDSet{}
+	err := docs.ForEach(legacyManifestsSide, "", func(k string, bz []byte) error {
+		ids[k] = SetEntry{}
+		return nil
+	})
+	return ids, err
+}
+
+// promoteLegacyManifests turns any of the given legacy manifests that have not been written since kinds existed into manifests,
+// keeping their versions and timestamps, since only their kind changes
+func (i *Index) promoteLegacyManifests(ids ...string) error {
+	return i.use(func() error {
+		pending := false
+		i.docs.DoWithMap(func(m map[string]Document) {
+			for _, id := range ids {
+				if _, ok := i.legacyManifests[id]; ok {
+					pending = true
+				}
+			}
+		})
+		if !pending {
+			return nil
+		}
+
+		return i.docs.UpdateMap(func(tx *storeTx) error {
+			settled := []string{}
+			promoted := []Document{}
+			changes := []membershipChange{}
+			for _, id := range ids {
+				if _, ok := i.legacyManifests[id]; !ok {
+					continue
+				}
+				tx.Remove(legacyManifestsSide, id)
+				settled = append(settled, id)
+
+				prev, ok := tx.Get(id)
+				if !ok || prev.Deleted || prev.Kind != DocumentKind {
+					continue
+				}
+				d, err := i.decodeBody(prev)
+				if err != nil {
+					return err
+				}
+				if !isLegacyManifestBody(d.Body) {
+					continue
+				}
+				d.Kind = ManifestKind
+				stored, err := i.encodeDocument(d)
+				if err != nil {
+					return err
+				}
+				tx.Set(id, stored)
+				promoted = append(promoted, stored)
+				if change, err := diffMembership(prev, stored, i.cipher); err != nil {
+					return err
+				} else if change != nil {
+					changes = append(changes, *change)
+				}
+			}
+			tx.OnCommit(func() {
+				for _, id := range settled {
+					delete(i.legacyManifests, id)
+				}
+				for _, d := range promoted {
+					i.cache.Add(d)
+					i.manifests.remove(d.ID)
+				}
+				for _, c := range changes {
+					i.membership.update(c.manifestID, c.before, c.after)
+				}
+			})
+			return nil
+		})
+	})
+}
@@ -0,0 +1,172 @@
+package mcache
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// compactManifestFormat is the first byte of a manifest body in compact form. JSON bodies always start with '{'.
+const compactManifestFormat byte = 0x01
+
+// encodeCompactManifest encodes a set of document IDs as a sorted, prefix-compressed list:
+// a format byte and ID count, then for each ID the length of the prefix it shares with the previous ID, the length of the rest, and the rest.
+func encodeCompactManifest(ids IDSet) []byte {
+	sorted := make([]string, 0, len(ids))
+	size := 0
+	for id := range ids {
+		sorted = append(sorted, id)
+		size += len(id)
+	}
+	sort.Strings(sorted)
+
+	bz := make([]byte, 1, 1+binary.MaxVarintLen64*(1+2*len(sorted))+size)
+	bz[0] = compactManifestFormat
+	bz = appendUvarint(bz, uint64(len(sorted)))
+
+	prev := ""
+	for _, id := range sorted {
+		shared := sharedPrefixLen(prev, id)
+		bz = appendUvarint(bz, uint64(shared))
+		bz = appendUvarint(bz, uint64(len(id)-shared))
+		bz = append(bz, id[shared:]...)
+		prev = id
+	}
+
+	return bz
+}
+
+// decodeManifestBody decodes a manifest body in either compact or JSON form
+func decodeManifestBody(body []byte) (IDSet, error) {
+	if len(body) == 0 || body[0] != compactManifestFormat {
+		ids := IDSet{}
+		if err := json.Unmarshal(body, &ids); err != nil {
+			return nil, err
+		}
+		return ids, nil
+	}
+
+	bz := body[1:]
+	count, err := readUvarint(&bz)
+	if err != nil {
+		return nil, err
+	}
+
+	// each ID takes at least two bytes (its prefix and suffix lengths), so a larger count is corrupt
+	if count > uint64(len(bz)/2) {
+		return nil, fmt.Errorf("Corrupt compact manifest")
+	}
+	ids := make(IDSet, count)
+	prev := ""
+	for n := uint64(0); n < count; n++ {
+		shared, err := readUvarint(&bz)
+		if err != nil {
+			return nil, err
+		}
+		suffixLen, err := readUvarint(&bz)
+		if err != nil {
+			return nil, err
+		}
+		if shared > uint64(len(prev)) || suffixLen > uint64(len(bz)) {
+			return nil, fmt.Errorf("Corrupt compact manifest")
+		}
+		id := prev[:shared] + string(bz[:suffixLen])
+		bz = bz[suffixLen:]
+		ids[id] = SetEntry{}
+		prev = id
+	}
+
+	return ids, nil
+}
+
+func appendUvarint(bz []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(bz, buf[:n]...)
+}
+
+func readUvarint(bz *[]byte) (uint64, error) {
+	v, n := binary.Uvarint(*bz)
+	if n <= 0 {
+		return 0, fmt.Errorf("Corrupt compact manifest")
+	}
+	*bz = (*bz)[n:]
+	return v, nil
+}
+
+func sharedPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// manifestCache holds decoded manifests, keyed by ID and checked against the Version of the stored document
+type manifestCache struct {
+	mut       *sync.Mutex
+	manifests map[string]*decodedManifest
+}
+
+// decodedManifest is a manifest's IDs along with its JSON-encoded body. Neither may be modified.
+type decodedManifest struct {
+	version int64
+	ids     IDSet
+	json    []byte
+}
+
+func newManifestCache() *manifestCache {
+	return &manifestCache{&sync.Mutex{}, map[string]*decodedManifest{}}
+}
+
+// get returns the decoded form of a stored manifest document, decrypting and decoding it with `cipher` if it is not cached
+func (c *manifestCache) get(d Document, cipher *bodyCipher) (*decodedManifest, error) {
+	c.mut.Lock()
+	cached := c.manifests[d.ID]
+	c.mut.Unlock()
+	if cached != nil && cached.version == d.Version {
+		return cached, nil
+	}
+
+	plain, err := decodeStoredBody(cipher, d)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := decodeManifestBody(plain.Body)
+	if err != nil {
+		return nil, err
+	}
+	bz, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded := &decodedManifest{d.Version, ids, bz}
+	c.mut.Lock()
+	c.manifests[d.ID] = decoded
+	c.mut.Unlock()
+	return decoded, nil
+}
+
+// remove forgets a manifest that was rewritten or removed, so its decoded form is not kept for a version that no longer exists
+func (c *manifestCache) remove(id string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	delete(c.manifests, id)
+}
+
+func (c *manifestCache) purge() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.manifests = map[string]*decodedManifest{}
+}
+
+func copyIDSet(ids IDSet) IDSet {
+	copied := make(IDSet, len(ids))
+	for id := range ids {
+		copied[id] = SetEntry{}
+	}
+	return copied
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"git.sr.ht/~dms/mcache"
+)
+
+const usage = `Usage:
+  mcache-server                                          run the server
+  mcache-server export <indexID> [file]                  write an index to a file (or stdout) as NDJSON
+  mcache-server import [-preserve-updated-at] <indexID> [file]
+                                                         read an NDJSON export from a file (or stdin) into an index, creating it if needed`
+
+// runCommand runs a command against the data directory instead of starting the server.
+// The server must not be running, since an index's file can only be opened by one process.
+func runCommand(name string, args []string) {
+	var err error
+	switch name {
+	case "export":
+		err = exportCommand(args, os.Stdout)
+	case "import":
+		err = importCommand(args, os.Stdout)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func exportCommand(args []string, out io.Writer) error {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	return withMCache(func(m *mcache.MCache) error {
+		w := out
+		if len(args) == 2 {
+			f, err := os.OpenFile(args[1], os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		records, err := m.Export(args[0], w)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Exported %v records from index %v\n", records, args[0])
+		return nil
+	})
+}
+
+func importCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	preserve := flags.Bool("preserve-updated-at", false, "keep the UpdatedAt and Version of imported documents, and import their previous versions")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	return withMCache(func(m *mcache.MCache) error {
+		var r io.Reader = os.Stdin
+		if len(args) == 2 {
+			f, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		if m.GetIndex(args[0]) == nil {
+			if _, err := m.CreateIndex(args[0]); err != nil {
+				return err
+			}
+		}
+		result, err := m.Import(args[0], r, mcache.ImportOptions{PreserveUpdatedAt: *preserve})
+		if err != nil {
+			return err
+		}
+		bz, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(bz))
+		return nil
+	})
+}
+
+// withMCache loads MCache with the server's configuration, calls `f`, then closes it.
+// MCache's logs are sent to stderr, so they are kept out of the command's output.
+func withMCache(f func(m *mcache.MCache) error) error {
+	m, err := mcache.NewMCache(loadConfig(os.Stderr))
+	if err != nil {
+		return fmt.Errorf("Error loading MCache: %v", err)
+	}
+	err = f(m)
+	if closeErr := m.Close(context.Background()); err == nil {
+		err = closeErr
+	}
+	return err
+}
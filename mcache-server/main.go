@@ -1,48 +1,610 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"git.sr.ht/~dms/mcache"
 	"github.com/joho/godotenv"
 	"github.com/julienschmidt/httprouter"
 )
 
+const shutdownTimeout = 30 * time.Second
+
+// clientHeader identifies the client making a query, so its cursor can be tracked separately from other clients'
+const clientHeader = "X-Mcache-Client"
+
 func main() {
-	config := loadConfig()
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	config := loadConfig(os.Stdout)
 	m, err := mcache.NewMCache(config)
 	if err != nil {
 		panic("Error loading MCache: " + err.Error())
 	}
 
-	buildHardcodedSampleIndex(m)
+	buildHardcodedSampleIndex(m)
+
+	router := httprouter.New()
+	router.POST("/i/:indexID", createHandler(m))
+	router.PUT("/i/:indexID", updateHandler(m))
+	router.GET("/i/:indexID/m/:manifestID/@/:updatedAfter", queryHandler(m, config.AdminToken))
+	router.GET("/i/:indexID/m", manifestsHandler(m))
+	router.POST("/i/:indexID/query", queryManyHandler(m))
+	router.POST("/i/:indexID/restore", restoreHandler(m))
+	router.GET("/i/:indexID/d/:docID", documentHandler(m))
+	router.PATCH("/i/:indexID/d/:docID", patchHandler(m))
+	router.GET("/i/:indexID/d/:docID/blob", blobHandler(m))
+	router.PUT("/i/:indexID/d/:docID/blob", putBlobHandler(m))
+	router.GET("/i/:indexID/settings", settingsHandler(m))
+
+	if config.AdminToken != "" {
+		// history exposes deleted and overwritten content, and settings control how long it is kept
+		// the status lists every index ID, so it is only shown to admins
+		router.GET("/admin/status", adminOnly(config.AdminToken, statusHandler(m)))
+		router.GET("/admin/i/:indexID/d/:docID/history", adminOnly(config.AdminToken, historyHandler(m)))
+		router.GET("/admin/i/:indexID/d/:docID/v/:version", adminOnly(config.AdminToken, versionHandler(m)))
+		router.PUT("/admin/i/:indexID/settings", adminOnly(config.AdminToken, updateSettingsHandler(m)))
+		router.GET("/admin/i/:indexID/d/:docID/manifests", adminOnly(config.AdminToken, manifestsContainingHandler(m)))
+		router.POST("/admin/i/:indexID/purge", adminOnly(config.AdminToken, purgeHandler(m)))
+		router.POST("/admin/i/:indexID/recompress", adminOnly(config.AdminToken, recompressHandler(m)))
+		router.POST("/admin/rewrap-keys", adminOnly(config.AdminToken, rewrapKeysHandler(m)))
+		router.GET("/admin/i/:indexID/snapshot", adminOnly(config.AdminToken, snapshotHandler(m)))
+		router.PUT("/admin/i/:indexID/snapshot", adminOnly(config.AdminToken, restoreSnapshotHandler(m)))
+		router.POST("/admin/snapshots", adminOnly(config.AdminToken, snapshotAllHandler(m, config.SnapshotDir)))
+		router.GET("/admin/i/:indexID/export", adminOnly(config.AdminToken, exportHandler(m)))
+		router.POST("/admin/i/:indexID/import", adminOnly(config.AdminToken, importHandler(m)))
+	}
+
+	srv := &http.Server{
+		Addr:    config.Host + ":" + config.Port,
+		Handler: router,
+	}
+
+	if config.TLSEnabled() {
+		srv.TLSConfig, err = mcache.NewTLSConfig(config)
+		if err != nil {
+			panic("Error configuring TLS: " + err.Error())
+		}
+		if config.DisableHTTP2 {
+			srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+	}
+
+	go serve(srv, config.TLSEnabled())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	fmt.Printf("Received %v, shutting down\n", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err = srv.Shutdown(ctx); err != nil {
+		fmt.Println("Error draining HTTP requests: " + err.Error())
+	}
+	if err = m.Close(ctx); err != nil {
+		fmt.Println("Error closing MCache: " + err.Error())
+		os.Exit(1)
+	}
+}
+
+func serve(srv *http.Server, tlsEnabled bool) {
+	var err error
+	if tlsEnabled {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		panic("Error serving HTTP: " + err.Error())
+	}
+}
+
+// queryHandler serves queries, which may only look back in history with `asOf` if they carry the admin token
+func queryHandler(m *mcache.MCache, adminToken string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		manifestID := ps.ByName("manifestID")
+		updatedAfterStr := ps.ByName("updatedAfter")
+		updatedAfter, err := strconv.ParseInt(updatedAfterStr, 10, 64)
+		if err != nil {
+			badRequest(&w, "Invalid updatedAfter ("+updatedAfterStr+")")
+			return
+		}
+
+		var docs *mcache.DocSet
+		if asOfStr := r.URL.Query().Get("asOf"); asOfStr != "" {
+			if !isAdmin(r, adminToken) {
+				unauthorized(&w)
+				return
+			}
+			asOf, parseErr := strconv.ParseInt(asOfStr, 10, 64)
+			if parseErr != nil {
+				badRequest(&w, "Invalid asOf ("+asOfStr+")")
+				return
+			}
+			docs, err = m.QueryAsOf(indexID, manifestID, updatedAfter, asOf)
+		} else {
+			known := map[string]int64{}
+			if knownStr := r.URL.Query().Get("known"); knownStr != "" {
+				if parseErr := json.Unmarshal([]byte(knownStr), &known); parseErr != nil {
+					badRequest(&w, "Invalid known ("+knownStr+")")
+					return
+				}
+			}
+			docs, err = m.QueryKnownAs(indexID, r.Header.Get(clientHeader), manifestID, updatedAfter, known)
+		}
+		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			if strings.HasPrefix(err.Error(), "Invalid") {
+				badRequest(&w, err.Error())
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+
+		bz, err := json.Marshal(docs)
+		if err != nil {
+			panic("Error encoding docs: " + err.Error())
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(200)
+		_, err = w.Write(bz)
+		if err != nil {
+			panic("Error writing HTTP response: " + err.Error())
+		}
+	}
+}
+
+func queryManyHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		bodyBz, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			badRequest(&w, "Error reading request body: "+err.Error())
+			return
+		}
+		queries := []mcache.ManifestQuery{}
+		if err = json.Unmarshal(bodyBz, &queries); err != nil {
+			badRequest(&w, "Error decoding request body: "+err.Error())
+			return
+		}
+
+		result, err := m.QueryManyAs(indexID, r.Header.Get(clientHeader), queries)
+		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			if strings.HasPrefix(err.Error(), "Invalid") {
+				badRequest(&w, err.Error())
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+
+		bz, err := json.Marshal(result)
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+
+		jsonSuccess(&w, bz)
+	}
+}
+
+func updateHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		bodyBz, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			badRequest(&w, "Error reading request body: "+err.Error())
+			return
+		}
+		docsArray := []mcache.Document{}
+		if err = json.Unmarshal(bodyBz, &docsArray); err != nil {
+			badRequest(&w, "Error decoding request body: "+err.Error())
+			return
+		}
+
+		docs := mcache.NewDocSet(docsArray...)
+		updated, err := m.Update(indexID, docs)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "Invalid") {
+				badRequest(&w, err.Error())
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+		body, err := json.Marshal(updated)
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+		jsonSuccess(&w, body)
+	}
+}
+
+func restoreHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		bodyBz, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			badRequest(&w, "Error reading request body: "+err.Error())
+			return
+		}
+		ids := []string{}
+		if err = json.Unmarshal(bodyBz, &ids); err != nil {
+			badRequest(&w, "Error decoding request body: "+err.Error())
+			return
+		}
+
+		restored, err := m.Restore(indexID, mcache.NewIDSet(ids...))
+		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			if strings.HasPrefix(err.Error(), "Invalid") {
+				badRequest(&w, err.Error())
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+
+		bz, err := json.Marshal(restored)
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+
+		jsonSuccess(&w, bz)
+	}
+}
+
+func documentHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		doc, err := m.Get(indexID, ps.ByName("docID"))
+		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			if strings.Contains(err.Error(), "not found") {
+				notFound(&w)
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+		if doc.Deleted {
+			notFound(&w)
+			return
+		}
+
+		header := w.Header()
+		etag := ""
+		if doc.Hash != "" {
+			etag = `"` + doc.Hash + `"`
+			header.Set("ETag", etag)
+		}
+		header.Set("Last-Modified", time.Unix(doc.UpdatedAt, 0).UTC().Format(http.TimeFormat))
+		header.Set("X-Mcache-Version", strconv.FormatInt(doc.Version, 10))
+		if etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(304)
+			return
+		}
+		header.Set("Content-Type", doc.MediaType())
+		setContentSafetyHeaders(header, doc.MediaType())
+		for k, v := range doc.Meta {
+			header.Set("X-Mcache-Meta-"+k, v)
+		}
+		w.WriteHeader(200)
+		w.Write(doc.Body)
+	}
+}
+
+// setContentSafetyHeaders stops browsers from sniffing a client-chosen content type, and has them download anything but JSON rather than render it
+func setContentSafetyHeaders(header http.Header, contentType string) {
+	header.Set("X-Content-Type-Options", "nosniff")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		header.Set("Content-Disposition", "attachment")
+	}
+}
+
+// etagMatches returns true if an If-None-Match header lists `etag`, comparing weakly as RFC 7232 requires
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func patchHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		patchType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || (patchType != mcache.MergePatchType && patchType != mcache.JSONPatchType) {
+			unsupportedMediaType(&w, "Patches must be sent as "+mcache.MergePatchType+" or "+mcache.JSONPatchType)
+			return
+		}
+		bodyBz, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			badRequest(&w, "Error reading request body: "+err.Error())
+			return
+		}
+
+		patched, err := m.Patch(indexID, ps.ByName("docID"), patchType, bodyBz)
+		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			if strings.Contains(err.Error(), "not found") && !strings.HasPrefix(err.Error(), "Invalid") {
+				notFound(&w)
+				return
+			}
+			if strings.HasPrefix(err.Error(), "Invalid") {
+				badRequest(&w, err.Error())
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+
+		bz, err := json.Marshal(patched)
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+
+		jsonSuccess(&w, bz)
+	}
+}
+
+func blobHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		f, doc, err := m.OpenBlob(indexID, ps.ByName("docID"))
+		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			if strings.Contains(err.Error(), "not found") {
+				notFound(&w)
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+		defer f.Close()
+
+		header := w.Header()
+		header.Set("ETag", `"`+doc.Blob.Hash+`"`)
+		header.Set("X-Mcache-Sha256", doc.Blob.Hash)
+		header.Set("X-Mcache-Version", strconv.FormatInt(doc.Version, 10))
+		if doc.Blob.ContentType != "" {
+			header.Set("Content-Type", doc.Blob.ContentType)
+		}
+		setContentSafetyHeaders(header, doc.Blob.ContentType)
+		http.ServeContent(w, r, "", time.Unix(doc.UpdatedAt, 0), f)
+	}
+}
+
+func putBlobHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		doc, err := m.PutBlob(indexID, ps.ByName("docID"), r.Body, r.Header.Get("Content-Type"), r.Header.Get("X-Mcache-Sha256"))
+		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			if strings.HasPrefix(err.Error(), "Invalid") {
+				badRequest(&w, err.Error())
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+
+		bz, err := json.Marshal(doc)
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+
+		jsonSuccess(&w, bz)
+	}
+}
+
+func historyHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		history, err := m.History(indexID, ps.ByName("docID"))
+		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			if strings.Contains(err.Error(), "not found") {
+				notFound(&w)
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+
+		bz, err := json.Marshal(history)
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+
+		jsonSuccess(&w, bz)
+	}
+}
+
+func versionHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		versionStr := ps.ByName("version")
+		version, err := strconv.ParseInt(versionStr, 10, 64)
+		if err != nil {
+			badRequest(&w, "Invalid version ("+versionStr+")")
+			return
+		}
+
+		doc, err := m.GetVersion(indexID, ps.ByName("docID"), version)
+		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			if strings.Contains(err.Error(), "not found") {
+				notFound(&w)
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+
+		bz, err := json.Marshal(doc)
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+
+		jsonSuccess(&w, bz)
+	}
+}
+
+func settingsHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		settings, err := m.Settings(indexID)
+		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+
+		bz, err := json.Marshal(settings)
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+
+		jsonSuccess(&w, bz)
+	}
+}
+
+func updateSettingsHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		bodyBz, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			badRequest(&w, "Error reading request body: "+err.Error())
+			return
+		}
+		settings := mcache.IndexSettings{}
+		if err = json.Unmarshal(bodyBz, &settings); err != nil {
+			badRequest(&w, "Error decoding request body: "+err.Error())
+			return
+		}
 
-	router := httprouter.New()
-	router.POST("/i/:indexID", createHandler(m))
-	router.PUT("/i/:indexID", updateHandler(m))
-	router.GET("/i/:indexID/m/:manifestID/@/:updatedAfter", queryHandler(m))
+		if err = m.SetSettings(indexID, settings); err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			if strings.HasPrefix(err.Error(), "Invalid") {
+				badRequest(&w, err.Error())
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+
+		bz, err := json.Marshal(settings)
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
 
-	http.ListenAndServe(config.Host+":"+config.Port, router)
+		jsonSuccess(&w, bz)
+	}
 }
 
-func queryHandler(m *mcache.MCache) httprouter.Handle {
+func createHandler(m *mcache.MCache) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		indexID := ps.ByName("indexID")
-		manifestID := ps.ByName("manifestID")
-		updatedAfterStr := ps.ByName("updatedAfter")
-		updatedAfter, err := strconv.ParseInt(updatedAfterStr, 10, 64)
+		if indexID == "" || len(indexID) > 512 {
+			badRequest(&w, "Invalid index id ("+indexID+")")
+			return
+		}
+
+		idx := m.GetIndex(indexID)
+		if idx != nil {
+			badRequest(&w, "Index exists")
+			return
+		}
+
+		idx, err := m.CreateIndex(indexID)
 		if err != nil {
-			badRequest(&w, "Invalid updatedAfter ("+updatedAfterStr+")")
+			unknownError(&w, err)
 			return
 		}
 
-		docs, err := m.Query(indexID, manifestID, updatedAfter)
+		bz, err := json.Marshal(idx)
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+
+		jsonSuccess(&w, bz)
+	}
+}
+
+func manifestsHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		manifests, err := m.Manifests(indexID)
 		if err != nil {
 			if strings.Contains(err.Error(), "No index") {
 				badRequest(&w, "Invalid index ("+indexID+")")
@@ -52,20 +614,52 @@ func queryHandler(m *mcache.MCache) httprouter.Handle {
 			return
 		}
 
-		bz, err := json.Marshal(docs)
+		bz, err := json.Marshal(manifests)
 		if err != nil {
-			panic("Error encoding docs: " + err.Error())
+			unknownError(&w, err)
+			return
 		}
-		w.Header().Add("Content-Type", "application/json")
-		w.WriteHeader(200)
-		_, err = w.Write(bz)
+
+		jsonSuccess(&w, bz)
+	}
+}
+
+func statusHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		bz, err := json.Marshal(m.Status())
 		if err != nil {
-			panic("Error writing HTTP response: " + err.Error())
+			unknownError(&w, err)
+			return
 		}
+
+		jsonSuccess(&w, bz)
 	}
 }
 
-func updateHandler(m *mcache.MCache) httprouter.Handle {
+func manifestsContainingHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		manifestIDs, err := m.ManifestsContaining(indexID, ps.ByName("docID"))
+		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+
+		bz, err := json.Marshal(manifestIDs)
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+
+		jsonSuccess(&w, bz)
+	}
+}
+
+func purgeHandler(m *mcache.MCache) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		indexID := ps.ByName("indexID")
 		bodyBz, err := ioutil.ReadAll(r.Body)
@@ -73,49 +667,166 @@ func updateHandler(m *mcache.MCache) httprouter.Handle {
 			badRequest(&w, "Error reading request body: "+err.Error())
 			return
 		}
-		docsArray := []mcache.Document{}
-		if err = json.Unmarshal(bodyBz, &docsArray); err != nil {
+		ids := []string{}
+		if err = json.Unmarshal(bodyBz, &ids); err != nil {
 			badRequest(&w, "Error decoding request body: "+err.Error())
 			return
 		}
 
-		docs := mcache.NewDocSet(docsArray...)
-		updated, err := m.Update(indexID, docs)
+		purged, err := m.Purge(indexID, mcache.NewIDSet(ids...))
 		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
 			unknownError(&w, err)
 			return
 		}
-		w.WriteHeader(200)
-		body, err := json.Marshal(updated)
+
+		bz, err := json.Marshal(purged)
 		if err != nil {
-			badRequest(&w, "Error decoding request body: "+err.Error())
+			unknownError(&w, err)
 			return
 		}
-		w.Write([]byte(body))
+
+		jsonSuccess(&w, bz)
 	}
 }
 
-func createHandler(m *mcache.MCache) httprouter.Handle {
+func recompressHandler(m *mcache.MCache) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		indexID := ps.ByName("indexID")
-		if indexID == "" || len(indexID) > 512 {
-			badRequest(&w, "Invalid index id ("+indexID+")")
+		rewritten, err := m.Recompress(indexID)
+		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			unknownError(&w, err)
 			return
 		}
 
-		idx := m.GetIndex(indexID)
-		if idx != nil {
-			badRequest(&w, "Index exists")
+		bz, err := json.Marshal(map[string]int{"rewritten": rewritten})
+		if err != nil {
+			unknownError(&w, err)
 			return
 		}
 
-		idx, err := m.CreateIndex(indexID)
+		jsonSuccess(&w, bz)
+	}
+}
+
+func rewrapKeysHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		checked, err := m.RewrapKeys()
 		if err != nil {
 			unknownError(&w, err)
 			return
 		}
 
-		bz, err := json.Marshal(idx)
+		bz, err := json.Marshal(map[string]int{"indexes": checked})
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+
+		jsonSuccess(&w, bz)
+	}
+}
+
+func snapshotHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		if m.GetIndex(indexID) == nil {
+			badRequest(&w, "Invalid index ("+indexID+")")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(indexID+".tar"))
+		if _, err := m.Snapshot(indexID, w); err != nil {
+			// the archive may already be partly sent, so the error can only be logged
+			fmt.Printf("Error writing snapshot of index %v: %v\n", indexID, err)
+		}
+	}
+}
+
+func restoreSnapshotHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		info, err := m.RestoreSnapshot(ps.ByName("indexID"), r.Body, r.URL.Query().Get("replace") == "true")
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "Invalid") {
+				badRequest(&w, err.Error())
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+
+		bz, err := json.Marshal(info)
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+
+		jsonSuccess(&w, bz)
+	}
+}
+
+func snapshotAllHandler(m *mcache.MCache, dir string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		paths, err := m.SnapshotAll(dir)
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+
+		bz, err := json.Marshal(map[string][]string{"paths": paths})
+		if err != nil {
+			unknownError(&w, err)
+			return
+		}
+
+		jsonSuccess(&w, bz)
+	}
+}
+
+func exportHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		if m.GetIndex(indexID) == nil {
+			badRequest(&w, "Invalid index ("+indexID+")")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(indexID+".ndjson"))
+		if _, err := m.Export(indexID, w); err != nil {
+			// the export may already be partly sent, so the error can only be logged
+			fmt.Printf("Error exporting index %v: %v\n", indexID, err)
+		}
+	}
+}
+
+func importHandler(m *mcache.MCache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		indexID := ps.ByName("indexID")
+		opts := mcache.ImportOptions{PreserveUpdatedAt: r.URL.Query().Get("preserveUpdatedAt") == "true"}
+		result, err := m.Import(indexID, r.Body, opts)
+		if err != nil {
+			if strings.Contains(err.Error(), "No index") {
+				badRequest(&w, "Invalid index ("+indexID+")")
+				return
+			}
+			if strings.HasPrefix(err.Error(), "Invalid") {
+				badRequest(&w, err.Error())
+				return
+			}
+			unknownError(&w, err)
+			return
+		}
+
+		bz, err := json.Marshal(result)
 		if err != nil {
 			unknownError(&w, err)
 			return
@@ -125,27 +836,59 @@ func createHandler(m *mcache.MCache) httprouter.Handle {
 	}
 }
 
+// adminOnly rejects requests that do not carry the admin token as a bearer token
+func adminOnly(token string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !isAdmin(r, token) {
+			unauthorized(&w)
+			return
+		}
+		handle(w, r, ps)
+	}
+}
+
+// isAdmin returns true if the request carries the admin token as a bearer token, which is never the case if no token is configured
+func isAdmin(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
 func badRequest(w *http.ResponseWriter, message string) {
-	(*w).WriteHeader(400)
 	(*w).Header().Add("Content-Type", "application/json")
+	(*w).WriteHeader(400)
 	(*w).Write([]byte("{\"error\":\"Bad request: " + message + "\"}"))
 }
 
 func notFound(w *http.ResponseWriter) {
-	(*w).WriteHeader(404)
 	(*w).Header().Add("Content-Type", "application/json")
+	(*w).WriteHeader(404)
 	(*w).Write([]byte("{\"error\":\"Not found\"}"))
 }
 
+func unauthorized(w *http.ResponseWriter) {
+	(*w).Header().Add("Content-Type", "application/json")
+	(*w).Header().Add("WWW-Authenticate", "Bearer")
+	(*w).WriteHeader(401)
+	(*w).Write([]byte("{\"error\":\"Unauthorized\"}"))
+}
+
+func unsupportedMediaType(w *http.ResponseWriter, message string) {
+	(*w).Header().Add("Content-Type", "application/json")
+	(*w).WriteHeader(415)
+	(*w).Write([]byte("{\"error\":\"Unsupported media type: " + message + "\"}"))
+}
+
 func unknownError(w *http.ResponseWriter, err error) {
-	(*w).WriteHeader(500)
 	(*w).Header().Add("Content-Type", "application/json")
+	(*w).WriteHeader(500)
 	(*w).Write([]byte("{\"error\":\"Unknown error: " + err.Error() + "\"}"))
 }
 
 func jsonSuccess(w *http.ResponseWriter, bz []byte) {
-	(*w).WriteHeader(200)
 	(*w).Header().Add("Content-Type", "application/json")
+	(*w).WriteHeader(200)
 	(*w).Write(bz)
 }
 
@@ -169,10 +912,11 @@ func buildHardcodedSampleIndex(m *mcache.MCache) {
 	}
 }
 
-func loadConfig() mcache.Config {
+// loadConfig reads the configuration from the environment, sending warnings and MCache's logs to `logOutput`
+func loadConfig(logOutput io.Writer) mcache.Config {
 	err := godotenv.Load()
 	if err != nil {
-		fmt.Println("Error loading .env file: " + err.Error())
+		fmt.Fprintln(logOutput, "Error loading .env file: "+err.Error())
 	}
 
 	host := os.Getenv("HOST")
@@ -192,15 +936,67 @@ func loadConfig() mcache.Config {
 
 	maxIndexCount := mustParseEnvInt("MC_MAX_INDEX_COUNT", mcache.DefaultConfig.MaxIndexCount)
 	maxIndexSize := mustParseEnvInt("MC_MAX_INDEX_SIZE", mcache.DefaultConfig.MaxIndexSize)
-	lruCacheSize := mustParseEnvInt("MC_LRU_CACHE_SIZE", mcache.DefaultConfig.LRUCacheSize)
+	cachePolicy := os.Getenv("MC_CACHE_POLICY")
+	if cachePolicy == "" {
+		cachePolicy = mcache.DefaultConfig.CachePolicy
+	}
+
+	cacheBytes := int64(mustParseEnvInt("MC_CACHE_BYTES", int(mcache.DefaultConfig.CacheBytes)))
+	cacheEntries := mustParseEnvInt("MC_CACHE_ENTRIES", mcache.DefaultConfig.CacheEntries)
+	if os.Getenv("MC_LRU_CACHE_SIZE") != "" {
+		// MC_LRU_CACHE_SIZE sized the per-index 2Q cache that predates cache policies, so it keeps that cache unless overridden
+		fmt.Fprintln(logOutput, "MC_LRU_CACHE_SIZE is deprecated, use MC_CACHE_POLICY=2q with MC_CACHE_ENTRIES, or MC_CACHE_BYTES")
+		if os.Getenv("MC_CACHE_ENTRIES") == "" {
+			cacheEntries = mustParseEnvInt("MC_LRU_CACHE_SIZE", cacheEntries)
+		}
+		if os.Getenv("MC_CACHE_POLICY") == "" {
+			cachePolicy = mcache.CachePolicy2Q
+		}
+	}
+	maxOpenIndexes := mustParseEnvInt("MC_MAX_OPEN_INDEXES", mcache.DefaultConfig.MaxOpenIndexes)
+	indexIdleTimeout := mustParseEnvDuration("MC_INDEX_IDLE_TIMEOUT", mcache.DefaultConfig.IndexIdleTimeout)
+	maxManifestDepth := mustParseEnvInt("MC_MAX_MANIFEST_DEPTH", mcache.DefaultConfig.MaxManifestDepth)
+	tombstoneRetention := mustParseEnvDuration("MC_TOMBSTONE_RETENTION", mcache.DefaultConfig.TombstoneRetention)
+	restoreRetention := mustParseEnvDuration("MC_RESTORE_RETENTION", mcache.DefaultConfig.RestoreRetention)
+	compactionInterval := mustParseEnvDuration("MC_COMPACTION_INTERVAL", mcache.DefaultConfig.CompactionInterval)
+	maxBlobSize := int64(mustParseEnvInt("MC_MAX_BLOB_SIZE", int(mcache.DefaultConfig.MaxBlobSize)))
+	snapshotDir := os.Getenv("MC_SNAPSHOT_DIR")
+	if snapshotDir == "" {
+		snapshotDir = mcache.DefaultConfig.SnapshotDir
+	}
+	masterKeys := mustLoadMasterKeys()
+	var masterKey []byte
+	if len(masterKeys) > 0 {
+		masterKey = masterKeys[0]
+		masterKeys = masterKeys[1:]
+	}
 
 	return mcache.Config{
-		Host:          host,
-		Port:          port,
-		DataDir:       dataDir,
-		MaxIndexCount: maxIndexCount,
-		MaxIndexSize:  maxIndexSize,
-		LRUCacheSize:  lruCacheSize,
+		Host:               host,
+		Port:               port,
+		DataDir:            dataDir,
+		MaxIndexCount:      maxIndexCount,
+		MaxIndexSize:       maxIndexSize,
+		CachePolicy:        cachePolicy,
+		CacheBytes:         cacheBytes,
+		CacheEntries:       cacheEntries,
+		MaxOpenIndexes:     maxOpenIndexes,
+		IndexIdleTimeout:   indexIdleTimeout,
+		MaxManifestDepth:   maxManifestDepth,
+		TombstoneRetention: tombstoneRetention,
+		RestoreRetention:   restoreRetention,
+		CompactionInterval: compactionInterval,
+		MaxBlobSize:        maxBlobSize,
+		TLSCertFile:        os.Getenv("MC_TLS_CERT_FILE"),
+		TLSKeyFile:         os.Getenv("MC_TLS_KEY_FILE"),
+		TLSClientCAFile:    os.Getenv("MC_TLS_CLIENT_CA_FILE"),
+		DisableHTTP2:       os.Getenv("MC_DISABLE_HTTP2") == "true",
+		WarmCache:          os.Getenv("MC_WARM_CACHE") == "true",
+		AdminToken:         os.Getenv("MC_ADMIN_TOKEN"),
+		SnapshotDir:        snapshotDir,
+		MasterKey:          masterKey,
+		PreviousMasterKeys: masterKeys,
+		LogOutput:          logOutput,
 	}
 }
 
@@ -215,3 +1011,43 @@ func mustParseEnvInt(key string, defaultVal int) int {
 	}
 	return valInt
 }
+
+// mustLoadMasterKeys reads base64-encoded master keys from the file named by MC_MASTER_KEY_FILE (one per line) or from MC_MASTER_KEY
+// (separated by commas). The first key is the current master key, and any others are previous keys that are being rotated out.
+func mustLoadMasterKeys() [][]byte {
+	encoded := os.Getenv("MC_MASTER_KEY")
+	separator := ","
+	if path := os.Getenv("MC_MASTER_KEY_FILE"); path != "" {
+		bz, err := ioutil.ReadFile(path)
+		if err != nil {
+			panic("Error reading MC_MASTER_KEY_FILE: " + err.Error())
+		}
+		encoded = string(bz)
+		separator = "\n"
+	}
+
+	keys := [][]byte{}
+	for _, k := range strings.Split(encoded, separator) {
+		if k = strings.TrimSpace(k); k == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			panic("Error decoding master key: " + err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func mustParseEnvDuration(key string, defaultVal time.Duration) time.Duration {
+	valStr := os.Getenv(key)
+	if len(valStr) == 0 {
+		return defaultVal
+	}
+	valDuration, err := time.ParseDuration(valStr)
+	if err != nil {
+		panic("Error parsing " + key)
+	}
+	return valDuration
+}
@@ -1,41 +1,210 @@
 package mcache
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/notduncansmith/mutable"
+)
+
+// ErrClosed is returned when writing to an MCache that has been closed
+var ErrClosed = errors.New("MCache is closed")
 
 // Config describes the configuration of an MCache instance
 type Config struct {
-	LRUCacheSize  int
 	MaxIndexCount int
 	MaxIndexSize  int
 	DataDir       string
 	Host          string
 	Port          string
+
+	// CachePolicy selects how documents are cached (see the CachePolicy constants)
+	CachePolicy string
+	// CacheBytes is the memory budget for cached documents, shared by all indexes (lru policy)
+	CacheBytes int64
+	// CacheEntries is the number of documents cached per index (2q and arc policies)
+	CacheEntries int
+	// LRUCacheSize is the number of documents cached per index by the 2Q cache that predates cache policies.
+	// Deprecated: use CachePolicy2Q and CacheEntries. If set, it sets CacheEntries, and selects the 2q policy unless arc or none is chosen.
+	LRUCacheSize int
+	// MaxOpenIndexes caps the number of index files open at once; the least recently used idle indexes are closed first
+	MaxOpenIndexes int
+	// IndexIdleTimeout is how long an index may go unused before it is closed (0 keeps indexes open)
+	IndexIdleTimeout time.Duration
+	// MaxManifestDepth limits how deeply manifests may include other manifests (defaultMaxManifestDepth if not positive)
+	MaxManifestDepth int
+	// TombstoneRetention is how long tombstones are kept before they may be compacted (0 keeps them forever)
+	TombstoneRetention time.Duration
+	// RestoreRetention is how long the last version of a deleted document is kept so the deletion can be undone (0 disables restoring)
+	RestoreRetention time.Duration
+	// CompactionInterval is how often open indexes are checked for tombstones to compact, deleted documents to expire and unreferenced blobs to remove
+	CompactionInterval time.Duration
+	// MaxBlobSize limits the size of blobs attached to documents (0 is unlimited)
+	MaxBlobSize int64
+	// WarmCache preloads each index's cache in the background when it is opened, starting with the most recently modified indexes at startup
+	WarmCache bool
+
+	// TLSCertFile and TLSKeyFile enable HTTPS when both are set
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile enables mutual TLS, requiring clients to present a certificate signed by this CA
+	TLSClientCAFile string
+	// DisableHTTP2 turns off HTTP/2, which is otherwise negotiated when TLS is enabled
+	DisableHTTP2 bool
+	// MasterKey enables encryption of document bodies at rest. Each index's bodies are encrypted with its own data key, which is stored in the
+	// index's file wrapped by the master key, so indexes cannot be opened without it. Existing indexes are encrypted when next opened.
+	// Blob files are not encrypted. It must be MasterKeySize bytes.
+	MasterKey []byte
+	// PreviousMasterKeys can still unwrap data keys, which are re-wrapped by MasterKey when their index is opened
+	PreviousMasterKeys [][]byte
+	// SnapshotDir is where MCache.SnapshotAll writes snapshots when triggered through the admin API
+	SnapshotDir string
+	// AdminToken is the bearer token required by the admin API, which is disabled if it is empty
+	AdminToken string
+	// LogOutput receives log messages, which are written to os.Stdout if it is nil
+	LogOutput io.Writer
+}
+
+// logf writes a log message to the configured LogOutput
+func (c Config) logf(format string, args ...interface{}) {
+	out := c.LogOutput
+	if out == nil {
+		out = os.Stdout
+	}
+	fmt.Fprintf(out, format, args...)
+}
+
+// defaultMaxManifestDepth is used when Config.MaxManifestDepth is not set
+const defaultMaxManifestDepth = 8
+
+// maxManifestDepth returns MaxManifestDepth, or the default if it is not set
+func (c Config) maxManifestDepth() int {
+	if c.MaxManifestDepth <= 0 {
+		return defaultMaxManifestDepth
+	}
+	return c.MaxManifestDepth
+}
+
+// withDeprecated maps deprecated settings onto the settings that replaced them
+func (c Config) withDeprecated() Config {
+	if c.LRUCacheSize > 0 {
+		c.CacheEntries = c.LRUCacheSize
+		if c.CachePolicy == "" || c.CachePolicy == CachePolicyLRU {
+			c.CachePolicy = CachePolicy2Q
+		}
+	}
+	return c
 }
 
 // DefaultConfig describes a default configuration for MCache
 var DefaultConfig = Config{
-	LRUCacheSize:  10000,
 	MaxIndexCount: 100000,
 	MaxIndexSize:  100000,
 	DataDir:       "./.mcache",
 	Host:          "localhost",
 	Port:          "1337",
+
+	CachePolicy:      CachePolicyLRU,
+	CacheBytes:       64 << 20,
+	CacheEntries:     10000,
+	MaxOpenIndexes:   1000,
+	IndexIdleTimeout: 10 * time.Minute,
+	MaxManifestDepth: defaultMaxManifestDepth,
+
+	RestoreRetention:   7 * 24 * time.Hour,
+	CompactionInterval: time.Hour,
+	MaxBlobSize:        1 << 30,
+	SnapshotDir:        "./.mcache-snapshots",
 }
 
 // MCache is an HTTP-accessible object cache
 type MCache struct {
-	im *IndexManager
+	im     *IndexManager
+	rw     *mutable.RW
+	closed bool
 	Config
 }
 
 // NewMCache returns an MCache with the given configuration
 func NewMCache(config Config) (*MCache, error) {
-	im := NewIndexManager(config)
-	err := im.Scan()
+	if config.LRUCacheSize > 0 {
+		config.logf("Config.LRUCacheSize is deprecated, use CachePolicy2Q with CacheEntries\n")
+		config = config.withDeprecated()
+	}
+	if err := validateTLS(config); err != nil {
+		return nil, err
+	}
+	im, err := NewIndexManager(config)
+	if err != nil {
+		return nil, err
+	}
+	err = im.Scan()
 	if err != nil {
 		return nil, err
 	}
-	return &MCache{im, config}, nil
+	return &MCache{im, mutable.NewRW("MCache:" + config.DataDir), false, config}, nil
+}
+
+// Close stops accepting writes, waits for in-flight writes to finish, and closes every index.
+// If `ctx` is done first, Close returns its error while closing continues in the background.
+func (m *MCache) Close(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		m.rw.DoWithRWLock(func() {
+			m.closed = true
+		})
+		done <- m.im.Close()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status describes the state of an MCache instance
+type Status struct {
+	Indexes     int                     `json:"indexes"`
+	OpenIndexes int                     `json:"openIndexes"`
+	Warmups     map[string]WarmupStatus `json:"warmups"`
+}
+
+// Status returns the number of known and open indexes, and the progress of any cache warm-ups
+func (m *MCache) Status() Status {
+	status := Status{OpenIndexes: m.im.OpenCount(), Warmups: map[string]WarmupStatus{}}
+	indexes := m.im.WithRLock(func() interface{} {
+		indexes := make([]*Index, 0, len(m.im.Indexes))
+		for _, i := range m.im.Indexes {
+			indexes = append(indexes, i)
+		}
+		return indexes
+	}).([]*Index)
+
+	status.Indexes = len(indexes)
+	for _, i := range indexes {
+		if warmup := i.WarmupStatus(); warmup != nil {
+			status.Warmups[i.ID] = *warmup
+		}
+	}
+	return status
+}
+
+// write calls `f` unless the MCache is closed; Close waits for any calls in progress
+func (m *MCache) write(f func() error) error {
+	err := ErrClosed
+	m.rw.DoWithRLock(func() {
+		if m.closed {
+			return
+		}
+		err = f()
+	})
+	return err
 }
 
 // GetIndex returns an internal Index object
@@ -44,8 +213,12 @@ func (m *MCache) GetIndex(id string) *Index {
 }
 
 // CreateIndex creates a new index with the given ID
-func (m *MCache) CreateIndex(id string) (*Index, error) {
-	return m.im.Open(id)
+func (m *MCache) CreateIndex(id string) (index *Index, err error) {
+	err = m.write(func() error {
+		index, err = m.im.Open(id)
+		return err
+	})
+	return
 }
 
 // Keys returns all keys in an index
@@ -54,7 +227,7 @@ func (m *MCache) Keys(indexID string) (IDSet, error) {
 	if index == nil {
 		return nil, fmt.Errorf("No index %v found", indexID)
 	}
-	return index.Keys(), nil
+	return index.Keys()
 }
 
 // Get gets a document in an index
@@ -75,6 +248,15 @@ func (m *MCache) GetAll(indexID string) (*DocSet, error) {
 	return index.GetAll()
 }
 
+// Manifests gets all manifests in an index
+func (m *MCache) Manifests(indexID string) ([]*Manifest, error) {
+	index := m.im.GetIndex(indexID)
+	if index == nil {
+		return nil, fmt.Errorf("No index %v found", indexID)
+	}
+	return index.Manifests()
+}
+
 // Query gets all index documents matching a given manifest that were updated after a given timestamp
 func (m *MCache) Query(indexID string, manifestID string, updatedAfter Timestamp) (*DocSet, error) {
 	index := m.im.GetIndex(indexID)
@@ -84,20 +266,270 @@ func (m *MCache) Query(indexID string, manifestID string, updatedAfter Timestamp
 	return index.Query(manifestID, updatedAfter)
 }
 
-// Update updates the index with the given documents
-func (m *MCache) Update(indexID string, docs *DocSet) (*DocSet, error) {
+// QueryAs is like Query, but records the query's cursor for the client with the given ID (see Index.QueryAs)
+func (m *MCache) QueryAs(indexID string, clientID string, manifestID string, updatedAfter Timestamp) (*DocSet, error) {
+	index := m.im.GetIndex(indexID)
+	if index == nil {
+		return nil, fmt.Errorf("No index %v found", indexID)
+	}
+	return index.QueryAs(clientID, manifestID, updatedAfter)
+}
+
+// QueryKnownAs is like QueryAs, but sends deltas for documents whose versions the client already holds (see Index.QueryKnownAs)
+func (m *MCache) QueryKnownAs(indexID string, clientID string, manifestID string, updatedAfter Timestamp, known map[string]int64) (*DocSet, error) {
+	index := m.im.GetIndex(indexID)
+	if index == nil {
+		return nil, fmt.Errorf("No index %v found", indexID)
+	}
+	return index.QueryKnownAs(clientID, manifestID, updatedAfter, known)
+}
+
+// QueryMany runs several manifest queries against an index at once
+func (m *MCache) QueryMany(indexID string, queries []ManifestQuery) (*QueryManyResult, error) {
+	index := m.im.GetIndex(indexID)
+	if index == nil {
+		return nil, fmt.Errorf("No index %v found", indexID)
+	}
+	return index.QueryMany(queries)
+}
+
+// QueryManyAs is like QueryMany, but records the queries' cursors for the client with the given ID (see Index.QueryAs)
+func (m *MCache) QueryManyAs(indexID string, clientID string, queries []ManifestQuery) (*QueryManyResult, error) {
 	index := m.im.GetIndex(indexID)
 	if index == nil {
 		return nil, fmt.Errorf("No index %v found", indexID)
 	}
-	return index.Update(docs)
+	return index.QueryManyAs(clientID, queries)
+}
+
+// ManifestsContaining returns the IDs of every manifest in an index that includes a document, directly or through other manifests
+func (m *MCache) ManifestsContaining(indexID string, docID string) (IDSet, error) {
+	index := m.im.GetIndex(indexID)
+	if index == nil {
+		return nil, fmt.Errorf("No index %v found", indexID)
+	}
+	return index.ManifestsContaining(docID)
+}
+
+// QueryAsOf gets the index documents matching a given manifest that were updated after a given timestamp, as they were at `asOf`
+func (m *MCache) QueryAsOf(indexID string, manifestID string, updatedAfter Timestamp, asOf Timestamp) (*DocSet, error) {
+	index := m.im.GetIndex(indexID)
+	if index == nil {
+		return nil, fmt.Errorf("No index %v found", indexID)
+	}
+	return index.QueryAsOf(manifestID, updatedAfter, asOf)
+}
+
+// History gets every kept version of a document in an index, oldest first
+func (m *MCache) History(indexID string, docID string) ([]Document, error) {
+	index := m.im.GetIndex(indexID)
+	if index == nil {
+		return nil, fmt.Errorf("No index %v found", indexID)
+	}
+	return index.History(docID)
+}
+
+// GetVersion gets a specific version of a document in an index
+func (m *MCache) GetVersion(indexID string, docID string, version int64) (*Document, error) {
+	index := m.im.GetIndex(indexID)
+	if index == nil {
+		return nil, fmt.Errorf("No index %v found", indexID)
+	}
+	return index.GetVersion(docID, version)
+}
+
+// Settings gets an index's settings
+func (m *MCache) Settings(indexID string) (IndexSettings, error) {
+	index := m.im.GetIndex(indexID)
+	if index == nil {
+		return IndexSettings{}, fmt.Errorf("No index %v found", indexID)
+	}
+	return index.Settings()
+}
+
+// SetSettings replaces an index's settings
+func (m *MCache) SetSettings(indexID string, settings IndexSettings) error {
+	return m.write(func() error {
+		index := m.im.GetIndex(indexID)
+		if index == nil {
+			return fmt.Errorf("No index %v found", indexID)
+		}
+		return index.SetSettings(settings)
+	})
+}
+
+// Update updates the index with the given documents
+func (m *MCache) Update(indexID string, docs *DocSet) (updated *DocSet, err error) {
+	err = m.write(func() error {
+		index := m.im.GetIndex(indexID)
+		if index == nil {
+			return fmt.Errorf("No index %v found", indexID)
+		}
+		updated, err = index.Update(docs)
+		return err
+	})
+	return
 }
 
 // SoftDelete overwrites documents in the given index with the given IDs with tombstone values
-func (m *MCache) SoftDelete(indexID string, ids IDSet) (*DocSet, error) {
+func (m *MCache) SoftDelete(indexID string, ids IDSet) (deleted *DocSet, err error) {
+	err = m.write(func() error {
+		index := m.im.GetIndex(indexID)
+		if index == nil {
+			return fmt.Errorf("No index %v found", indexID)
+		}
+		deleted, err = index.SoftDelete(ids)
+		return err
+	})
+	return
+}
+
+// Purge permanently removes documents with the given IDs from an index, returning the IDs of those that existed
+func (m *MCache) Purge(indexID string, ids IDSet) (purged IDSet, err error) {
+	err = m.write(func() error {
+		index := m.im.GetIndex(indexID)
+		if index == nil {
+			return fmt.Errorf("No index %v found", indexID)
+		}
+		purged, err = index.Purge(ids)
+		return err
+	})
+	return
+}
+
+// RewrapKeys opens every index, which re-wraps any data key still wrapped by a previous master key so that key can be retired.
+// It returns the number of indexes checked.
+func (m *MCache) RewrapKeys() (checked int, err error) {
+	err = m.write(func() error {
+		indexes := m.im.WithRLock(func() interface{} {
+			indexes := make([]*Index, 0, len(m.im.Indexes))
+			for _, i := range m.im.Indexes {
+				indexes = append(indexes, i)
+			}
+			return indexes
+		}).([]*Index)
+
+		for _, i := range indexes {
+			if err := i.use(func() error { return nil }); err != nil {
+				return fmt.Errorf("Failed to open index %v: %v", i.ID, err)
+			}
+			checked++
+		}
+		return nil
+	})
+	return
+}
+
+// Recompress rewrites the bodies of an index's documents to match its compression settings, returning the number of documents rewritten
+func (m *MCache) Recompress(indexID string) (rewritten int, err error) {
+	err = m.write(func() error {
+		index := m.im.GetIndex(indexID)
+		if index == nil {
+			return fmt.Errorf("No index %v found", indexID)
+		}
+		rewritten, err = index.Recompress()
+		return err
+	})
+	return
+}
+
+// Restore undoes the deletion of documents in an index, returning their restored versions
+func (m *MCache) Restore(indexID string, ids IDSet) (restored *DocSet, err error) {
+	err = m.write(func() error {
+		index := m.im.GetIndex(indexID)
+		if index == nil {
+			return fmt.Errorf("No index %v found", indexID)
+		}
+		restored, err = index.Restore(ids)
+		return err
+	})
+	return
+}
+
+// Patch applies a merge patch or JSON Patch to the JSON body of a document in an index, returning the new version
+func (m *MCache) Patch(indexID string, docID string, patchType string, patch []byte) (patched *Document, err error) {
+	err = m.write(func() error {
+		index := m.im.GetIndex(indexID)
+		if index == nil {
+			return fmt.Errorf("No index %v found", indexID)
+		}
+		patched, err = index.Patch(docID, patchType, patch)
+		return err
+	})
+	return
+}
+
+// PutBlob stores a blob as the attachment of a document (see Index.PutBlob)
+func (m *MCache) PutBlob(indexID string, docID string, r io.Reader, contentType string, checksum string) (doc *Document, err error) {
+	err = m.write(func() error {
+		index := m.im.GetIndex(indexID)
+		if index == nil {
+			return fmt.Errorf("No index %v found", indexID)
+		}
+		doc, err = index.PutBlob(docID, r, contentType, checksum)
+		return err
+	})
+	return
+}
+
+// OpenBlob opens the blob attached to a document. The caller must close the file.
+func (m *MCache) OpenBlob(indexID string, docID string) (*os.File, *Document, error) {
+	index := m.im.GetIndex(indexID)
+	if index == nil {
+		return nil, nil, fmt.Errorf("No index %v found", indexID)
+	}
+	return index.OpenBlob(docID)
+}
+
+// Snapshot writes a snapshot archive of an index (see Index.Snapshot)
+func (m *MCache) Snapshot(indexID string, w io.Writer) (*SnapshotInfo, error) {
 	index := m.im.GetIndex(indexID)
 	if index == nil {
 		return nil, fmt.Errorf("No index %v found", indexID)
 	}
-	return index.SoftDelete(ids)
+	info, err := index.Snapshot(w)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// SnapshotAll writes a snapshot of every index to a new file in `dir`, returning the paths of the files
+func (m *MCache) SnapshotAll(dir string) (paths []string, err error) {
+	err = m.write(func() error {
+		paths, err = m.im.SnapshotAll(dir)
+		return err
+	})
+	return
+}
+
+// RestoreSnapshot loads a snapshot archive as the index with the given ID, replacing an existing index only if `replace` is true
+func (m *MCache) RestoreSnapshot(indexID string, r io.Reader, replace bool) (info *SnapshotInfo, err error) {
+	err = m.write(func() error {
+		info, err = m.im.Restore(indexID, r, replace)
+		return err
+	})
+	return
+}
+
+// Export writes every document of an index, with its kept previous versions, to `w` as NDJSON
+func (m *MCache) Export(indexID string, w io.Writer) (records int, err error) {
+	index := m.im.GetIndex(indexID)
+	if index == nil {
+		return 0, fmt.Errorf("No index %v found", indexID)
+	}
+	return index.Export(w)
+}
+
+// Import writes the documents of an NDJSON export read from `r` to an index
+func (m *MCache) Import(indexID string, r io.Reader, opts ImportOptions) (result ImportResult, err error) {
+	err = m.write(func() error {
+		index := m.im.GetIndex(indexID)
+		if index == nil {
+			return fmt.Errorf("No index %v found", indexID)
+		}
+		result, err = index.Import(r, opts)
+		return err
+	})
+	return
 }
@@ -1,11 +1,26 @@
 package mcache
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	mp "github.com/vmihailenco/msgpack"
 )
 
 const testDataDir = "./.tmp"
@@ -13,8 +28,8 @@ const testIndexName = "test"
 const testManifestName = "m:a&b"
 
 func TestMCacheRoundtrip(t *testing.T) {
-	os.RemoveAll(testDataDir + "/mcache-*")
-	defer os.RemoveAll(testDataDir + "/mcache-*")
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
 	now := time.Now()
 	manifestDoc, _ := (&Manifest{
 		ID:          "m:a&b",
@@ -67,7 +82,7 @@ func TestMCacheRoundtrip(t *testing.T) {
 		t.Fatalf("Failed to query index: %v", err)
 	}
 
-	expected := NewDocSet(knownDocs.Docs["a"], knownDocs.Docs["b"])
+	expected := NewDocSet(knownDocs.Docs["a"], knownDocs.Docs["b"], knownDocs.Docs[testManifestName])
 	expectDocs(t, expected, results)
 
 	manifest, err := idx.GetManifest(testManifestName)
@@ -96,7 +111,7 @@ func TestMCacheRoundtrip(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to query index: %v", err)
 	}
-	expected = NewDocSet(knownDocs.Docs["a"], knownDocs.Docs["b"], knownDocs.Docs["c"])
+	expected = NewDocSet(knownDocs.Docs["a"], knownDocs.Docs["b"], knownDocs.Docs["c"], knownDocs.Docs[testManifestName])
 	expectDocs(t, expected, results)
 
 	stored, err = m.SoftDelete(testIndexName, NewIDSet("c"))
@@ -110,7 +125,7 @@ func TestMCacheRoundtrip(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to query index: %v", err)
 	}
-	expected = NewDocSet(knownDocs.Docs["a"], knownDocs.Docs["b"], knownDocs.Docs["c"])
+	expected = NewDocSet(knownDocs.Docs["a"], knownDocs.Docs["b"], knownDocs.Docs["c"], knownDocs.Docs[testManifestName])
 	expectDocs(t, expected, results)
 
 	result, err := m.Get(idx.ID, "c")
@@ -121,6 +136,1952 @@ func TestMCacheRoundtrip(t *testing.T) {
 	expectDocs(t, expected, results)
 }
 
+func TestManifestKind(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	if _, err = m.CreateIndex("kinds"); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+
+	manifestDoc, _ := (&Manifest{ID: "m", DocumentIDs: NewIDSet("a")}).Encode()
+	if _, err = m.Update("kinds", NewDocSet(*manifestDoc, Document{ID: "a", Body: []byte("{}")})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+
+	if _, err = m.Query("kinds", "a", 0); err == nil {
+		t.Fatalf("Expected querying a document as a manifest to fail")
+	}
+	if _, err = m.Update("kinds", NewDocSet(Document{ID: "m", Body: []byte("garbage")})); err == nil {
+		t.Fatalf("Expected replacing a manifest with a document to fail")
+	}
+	if _, err = m.Update("kinds", NewDocSet(Document{ID: "n", Kind: ManifestKind, Body: []byte("garbage")})); err == nil {
+		t.Fatalf("Expected invalid manifest body to be rejected")
+	}
+
+	manifests, err := m.Manifests("kinds")
+	if err != nil {
+		t.Fatalf("Failed to list manifests: %v", err)
+	}
+	if len(manifests) != 1 || manifests[0].ID != "m" {
+		t.Fatalf("Expected manifest m to be listed, got %+v", manifests)
+	}
+}
+
+func TestLegacyManifestMigration(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	os.MkdirAll(testDataDir, 0700)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	// documents written before kinds existed have no kind
+	legacy, err := openDocStore(testDataDir+"/"+indexFilenamePrefix+"legacy"+indexFilenameSuffix, "legacy")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	legacy.UpdateMap(func(tx *storeTx) error {
+		tx.Set("a", Document{ID: "a", UpdatedAt: 1, Version: 1, Body: []byte("Document A")})
+		tx.Set("m", Document{ID: "m", UpdatedAt: 1, Version: 3, Body: []byte(`{"a": {}}`)})
+		tx.Set("config", Document{ID: "config", UpdatedAt: 1, Version: 1, Body: []byte(`{"a":{"x":1}}`)})
+		tx.Set("empty", Document{ID: "empty", UpdatedAt: 1, Version: 1, Body: []byte(`{}`)})
+		return nil
+	})
+	legacy.Close()
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	for _, id := range []string{"m", "config", "empty"} {
+		if d, err := m.Get("legacy", id); err != nil || d.Kind != DocumentKind {
+			t.Fatalf("Expected legacy document %v to be migrated as a document, got %v %v", id, d, err)
+		}
+	}
+	if _, err = m.Update("legacy", NewDocSet(Document{ID: "config", Body: []byte(`{"a":{"x":2}}`)}, Document{ID: "empty", Body: []byte(`{}`)})); err != nil {
+		t.Fatalf("Expected plain writes to legacy documents to succeed: %v", err)
+	}
+
+	results, err := m.Query("legacy", "m", 0)
+	if err != nil {
+		t.Fatalf("Expected a legacy manifest to be queryable: %v", err)
+	}
+	if _, ok := results.Docs["a"]; !ok {
+		t.Fatalf("Expected legacy manifest to include a, got %v", results)
+	}
+	if d, err := m.Get("legacy", "m"); err != nil || d.Kind != ManifestKind || d.Version != 3 || d.UpdatedAt != 1 {
+		t.Fatalf("Expected queried legacy document to become a manifest without a new version, got %v %v", d, err)
+	}
+	if _, err = m.Query("legacy", "empty", 0); err == nil {
+		t.Fatalf("Expected a legacy document written since migration to stay a document")
+	}
+
+	// writes without a kind keep the kind of the manifest they replace
+	if _, err = m.Update("legacy", NewDocSet(Document{ID: "m", Body: []byte(`{"a":{},"config":{}}`)})); err != nil {
+		t.Fatalf("Expected a write without a kind to replace a manifest: %v", err)
+	}
+	if d, err := m.Get("legacy", "m"); err != nil || d.Kind != ManifestKind {
+		t.Fatalf("Expected m to stay a manifest, got %v %v", d, err)
+	}
+}
+
+func TestCompactManifest(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	idx, err := m.CreateIndex("compact")
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+
+	manifest := &Manifest{ID: "m", DocumentIDs: IDSet{}}
+	for n := 0; n < 50000; n++ {
+		manifest.Add(fmt.Sprintf("doc-%08d", n))
+	}
+	manifestDoc, _ := manifest.Encode()
+	if _, err = idx.Update(NewDocSet(*manifestDoc)); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+
+	var stored Document
+	idx.view(func(m map[string]Document) error {
+		stored = m["m"]
+		return nil
+	})
+	if len(stored.Body) >= len(manifestDoc.Body)/2 {
+		t.Fatalf("Expected compact manifest to be much smaller than %v bytes, got %v", len(manifestDoc.Body), len(stored.Body))
+	}
+
+	results, err := idx.Query("m", 0)
+	if err != nil {
+		t.Fatalf("Failed to query index: %v", err)
+	}
+	decoded, err := DecodeManifest(results.Docs["m"])
+	if err != nil || results.Docs["m"].Body[0] != '{' {
+		t.Fatalf("Expected queried manifest body to be JSON: %v", err)
+	}
+	if diff := cmp.Diff(manifest.DocumentIDs, decoded.DocumentIDs); diff != "" {
+		t.Fatalf("Manifest keys mismatch (-expected +actual):\n%s", diff)
+	}
+
+	// a corrupt count must not be trusted to size the decoded set
+	hostile := appendUvarint([]byte{compactManifestFormat}, 1<<62)
+	if _, err = decodeManifestBody(append(hostile, 0, 1, 'a')); err == nil {
+		t.Fatalf("Expected a compact manifest with an impossible count to be rejected")
+	}
+
+	// decoded manifests are cached by version, so versions written in the same second are told apart
+	cache := newManifestCache()
+	first := Document{ID: "m", Kind: ManifestKind, UpdatedAt: 1, Version: 1, Body: encodeCompactManifest(NewIDSet("a"))}
+	second := Document{ID: "m", Kind: ManifestKind, UpdatedAt: 1, Version: 2, Body: encodeCompactManifest(NewIDSet("b"))}
+	for _, d := range []Document{first, second} {
+		decoded, err := cache.get(d, nil)
+		if err != nil || len(decoded.ids) != 1 || decoded.version != d.Version {
+			t.Fatalf("Expected version %v to be decoded, got %v %v", d.Version, decoded, err)
+		}
+	}
+	if decoded, _ := cache.get(second, nil); !cmp.Equal(NewIDSet("b"), decoded.ids) {
+		t.Fatalf("Expected the latest version to be cached, got %v", decoded.ids)
+	}
+}
+
+func TestNestedManifests(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+	config.MaxManifestDepth = 2
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	if _, err = m.CreateIndex("nested"); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+
+	user, _ := (&Manifest{ID: "user", DocumentIDs: NewIDSet("a", "team")}).Encode()
+	team, _ := (&Manifest{ID: "team", DocumentIDs: NewIDSet("b", "org")}).Encode()
+	// org includes user, forming a cycle
+	org, _ := (&Manifest{ID: "org", DocumentIDs: NewIDSet("c", "user")}).Encode()
+	stored, err := m.Update("nested", NewDocSet(*user, *team, *org, Document{ID: "a"}, Document{ID: "b"}, Document{ID: "c"}, Document{ID: "d"}))
+	if err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+
+	results, err := m.Query("nested", "user", 0)
+	if err != nil {
+		t.Fatalf("Failed to query index: %v", err)
+	}
+	expected := NewDocSet(stored.Docs["user"], stored.Docs["team"], stored.Docs["org"], stored.Docs["a"], stored.Docs["b"], stored.Docs["c"])
+	expectDocs(t, expected, results)
+
+	// org is two levels below user, so including another manifest from it exceeds the depth limit
+	org, _ = (&Manifest{ID: "org", DocumentIDs: NewIDSet("c", "dept")}).Encode()
+	dept, _ := (&Manifest{ID: "dept", DocumentIDs: NewIDSet("d")}).Encode()
+	if _, err = m.Update("nested", NewDocSet(*org, *dept)); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if _, err = m.Query("nested", "user", 0); err == nil {
+		t.Fatalf("Expected manifests nested beyond the depth limit to fail")
+	}
+
+	if depth := (Config{}).maxManifestDepth(); depth != defaultMaxManifestDepth {
+		t.Fatalf("Expected an unset depth limit to default to %v, got %v", defaultMaxManifestDepth, depth)
+	}
+}
+
+func TestQueryMany(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	if _, err = m.CreateIndex("querymany"); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+
+	m1, _ := (&Manifest{ID: "m1", DocumentIDs: NewIDSet("a", "shared")}).Encode()
+	m2, _ := (&Manifest{ID: "m2", DocumentIDs: NewIDSet("b", "shared")}).Encode()
+	stored, err := m.Update("querymany", NewDocSet(*m1, *m2, Document{ID: "a"}, Document{ID: "b"}, Document{ID: "shared"}))
+	if err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	written := stored.Docs["a"].UpdatedAt
+
+	// m1 is already up to date, but "shared" is still returned once for m2
+	result, err := m.QueryMany("querymany", []ManifestQuery{{ManifestID: "m1", After: written}, {ManifestID: "m2"}})
+	if err != nil {
+		t.Fatalf("Failed to query index: %v", err)
+	}
+	expected := NewDocSet(stored.Docs["m2"], stored.Docs["b"], stored.Docs["shared"])
+	expectDocs(t, expected, result.DocSet)
+	if result.Cursors["m1"] != written || result.Cursors["m2"] != written {
+		t.Fatalf("Expected both cursors to be %v, got %v", written, result.Cursors)
+	}
+
+	if _, err = m.QueryMany("querymany", []ManifestQuery{{ManifestID: "m1"}, {ManifestID: "missing"}}); err == nil {
+		t.Fatalf("Expected a query for a missing manifest to fail")
+	}
+}
+
+func TestManifestsContaining(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	idx, err := m.CreateIndex("membership")
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+
+	inner, _ := (&Manifest{ID: "inner", DocumentIDs: NewIDSet("a", "b")}).Encode()
+	outer, _ := (&Manifest{ID: "outer", DocumentIDs: NewIDSet("inner")}).Encode()
+	other, _ := (&Manifest{ID: "other", DocumentIDs: NewIDSet("b")}).Encode()
+	if _, err = m.Update("membership", NewDocSet(*inner, *outer, *other, Document{ID: "a"}, Document{ID: "b"})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+
+	expectContaining := func(docID string, expected IDSet) {
+		t.Helper()
+		actual, err := m.ManifestsContaining("membership", docID)
+		if err != nil {
+			t.Fatalf("Failed to find manifests containing %v: %v", docID, err)
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Fatalf("Unexpected manifests containing %v: %v", docID, diff)
+		}
+	}
+	expectContaining("a", NewIDSet("inner", "outer"))
+	expectContaining("b", NewIDSet("inner", "outer", "other"))
+
+	inner, _ = (&Manifest{ID: "inner", DocumentIDs: NewIDSet("b")}).Encode()
+	if _, err = m.Update("membership", NewDocSet(*inner)); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if _, err = m.SoftDelete("membership", NewIDSet("other")); err != nil {
+		t.Fatalf("Failed to delete manifest: %v", err)
+	}
+	expectContaining("a", IDSet{})
+	expectContaining("b", NewIDSet("inner", "outer"))
+
+	// the reverse index is rebuilt when the index is reopened
+	if !idx.closeIfIdle(time.Now()) {
+		t.Fatalf("Expected the idle index to close")
+	}
+	expectContaining("b", NewIDSet("inner", "outer"))
+}
+
+func TestPurgeAndCompaction(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	idx, err := m.CreateIndex("purge")
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+
+	manifestDoc, _ := (&Manifest{ID: "m", DocumentIDs: NewIDSet("a", "b", "c")}).Encode()
+	if _, err = m.Update("purge", NewDocSet(*manifestDoc, Document{ID: "a"}, Document{ID: "b"}, Document{ID: "c"})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+
+	purged, err := m.Purge("purge", NewIDSet("a", "missing"))
+	if err != nil {
+		t.Fatalf("Failed to purge documents: %v", err)
+	}
+	if diff := cmp.Diff(NewIDSet("a"), purged); diff != "" {
+		t.Fatalf("Unexpected purged documents: %v", diff)
+	}
+	if _, err = m.Get("purge", "a"); err == nil {
+		t.Fatalf("Expected purged document to be gone")
+	}
+
+	deleted, err := m.SoftDelete("purge", NewIDSet("b"))
+	if err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+	backdate(t, idx, 2*60*60, "b")
+	deletedAt := deleted.Docs["b"].UpdatedAt - 2*60*60
+
+	// a client is known to be behind the deletion, so the tombstone is kept
+	if _, err = m.QueryAs("purge", "client", "m", deletedAt-1); err != nil {
+		t.Fatalf("Failed to query index: %v", err)
+	}
+	if compacted, err := idx.CompactTombstones(time.Hour); err != nil || compacted != 0 {
+		t.Fatalf("Expected no tombstones to be compacted, got %v (%v)", compacted, err)
+	}
+
+	// once every known cursor has passed it, the tombstone is compacted after its retention
+	if _, err = m.QueryAs("purge", "client", "m", deletedAt); err != nil {
+		t.Fatalf("Failed to query index: %v", err)
+	}
+	if compacted, err := idx.CompactTombstones(3 * time.Hour); err != nil || compacted != 0 {
+		t.Fatalf("Expected recent tombstones to be kept, got %v (%v)", compacted, err)
+	}
+	if compacted, err := idx.CompactTombstones(time.Hour); err != nil || compacted != 1 {
+		t.Fatalf("Expected one tombstone to be compacted, got %v (%v)", compacted, err)
+	}
+
+	keys, err := m.Keys("purge")
+	if err != nil {
+		t.Fatalf("Failed to list keys: %v", err)
+	}
+	if diff := cmp.Diff(NewIDSet("m", "c"), keys); diff != "" {
+		t.Fatalf("Unexpected keys after compaction: %v", diff)
+	}
+}
+
+// backdate moves the UpdatedAt of stored documents back by `seconds`, as if they had been written that long ago
+func backdate(t *testing.T, idx *Index, seconds Timestamp, ids ...string) {
+	t.Helper()
+	if err := idx.acquire(); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	defer idx.release()
+	if err := idx.docs.UpdateMap(func(tx *storeTx) error {
+		for _, id := range ids {
+			d, _ := tx.Get(id)
+			d.UpdatedAt -= seconds
+			tx.Set(id, d)
+			tx.OnCommit(func() { idx.cache.Add(d) })
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to backdate documents: %v", err)
+	}
+}
+
+func TestCompactionCursors(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	if _, err = m.CreateIndex("cursors"); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	m1, _ := (&Manifest{ID: "m1", DocumentIDs: NewIDSet("a", "b")}).Encode()
+	m2, _ := (&Manifest{ID: "m2", DocumentIDs: NewIDSet("c")}).Encode()
+	if _, err = m.Update("cursors", NewDocSet(*m1, *m2, Document{ID: "a"}, Document{ID: "b"}, Document{ID: "c"})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	deleted, err := m.SoftDelete("cursors", NewIDSet("b", "c"))
+	if err != nil {
+		t.Fatalf("Failed to delete documents: %v", err)
+	}
+	backdate(t, m.GetIndex("cursors"), 2*60*60, "b", "c")
+	deletedAt := deleted.Docs["b"].UpdatedAt - 2*60*60
+	compact := func(expected int) {
+		t.Helper()
+		if compacted, err := m.GetIndex("cursors").CompactTombstones(time.Hour); err != nil || compacted != expected {
+			t.Fatalf("Expected %v tombstones to be compacted, got %v (%v)", expected, compacted, err)
+		}
+	}
+
+	// no client is known to have queried either manifest
+	compact(0)
+
+	// one client has seen the deletion, but another is behind it
+	if _, err = m.QueryAs("cursors", "fast", "m1", deletedAt); err != nil {
+		t.Fatalf("Failed to query index: %v", err)
+	}
+	if _, err = m.QueryManyAs("cursors", "slow", []ManifestQuery{{ManifestID: "m1", After: deletedAt - 1}}); err != nil {
+		t.Fatalf("Failed to query index: %v", err)
+	}
+	// anonymous queries only mark a manifest as queried, so a full sync without a client ID does not keep its tombstones
+	if _, err = m.Query("cursors", "m2", 0); err != nil {
+		t.Fatalf("Failed to query index: %v", err)
+	}
+	compact(1)
+	if _, err = m.Get("cursors", "c"); err == nil {
+		t.Fatalf("Expected the tombstone of the anonymously queried manifest to be compacted")
+	}
+
+	// cursors are kept when the index is reopened
+	if err = m.Close(context.Background()); err != nil {
+		t.Fatalf("Failed to close mcache: %v", err)
+	}
+	if m, err = NewMCache(config); err != nil {
+		t.Fatalf("Failed to reopen mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	compact(0)
+
+	// a client that has not synced within the retention is forgotten, and no longer keeps tombstones
+	idx := m.GetIndex("cursors")
+	idx.mut.Lock()
+	slow := idx.cursors["m1"]["slow"]
+	slow.seenAt -= 2 * 60 * 60
+	idx.cursors["m1"]["slow"] = slow
+	idx.mut.Unlock()
+	compact(1)
+	idx.mut.Lock()
+	_, known := idx.cursors["m1"]["slow"]
+	idx.mut.Unlock()
+	if known {
+		t.Fatalf("Expected the stale cursor to be forgotten")
+	}
+
+	if _, err = m.QueryAs("cursors", strings.Repeat("x", MaxClientIDLength+1), "m1", 0); err == nil {
+		t.Fatalf("Expected a long client ID to be rejected")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	idx, err := m.CreateIndex("restore")
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+
+	manifestDoc, _ := (&Manifest{ID: "m", DocumentIDs: NewIDSet("a")}).Encode()
+	if _, err = m.Update("restore", NewDocSet(*manifestDoc, Document{ID: "a", Body: []byte("A")}, Document{ID: "b", Body: []byte("B")})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if _, err = m.Restore("restore", NewIDSet("a")); err == nil {
+		t.Fatalf("Expected restoring a live document to fail")
+	}
+	if _, err = m.SoftDelete("restore", NewIDSet("a", "b", "m")); err != nil {
+		t.Fatalf("Failed to delete documents: %v", err)
+	}
+
+	restored, err := m.Restore("restore", NewIDSet("a", "m"))
+	if err != nil {
+		t.Fatalf("Failed to restore documents: %v", err)
+	}
+	if string(restored.Docs["a"].Body) != "A" || restored.Docs["a"].Deleted {
+		t.Fatalf("Unexpected restored document: %v", restored.Docs["a"])
+	}
+	manifest, err := idx.GetManifest("m")
+	if err != nil {
+		t.Fatalf("Failed to get restored manifest: %v", err)
+	}
+	if diff := cmp.Diff(NewIDSet("a"), manifest.DocumentIDs); diff != "" {
+		t.Fatalf("Unexpected restored manifest: %v", diff)
+	}
+
+	// a restored document's saved version is discarded, so it must be deleted again before it can be restored
+	if _, err = m.Restore("restore", NewIDSet("a")); err == nil {
+		t.Fatalf("Expected restoring a restored document to fail")
+	}
+
+	if expired, err := idx.ExpireTrash(-time.Hour); err != nil || expired != 1 {
+		t.Fatalf("Expected one deleted document to expire, got %v (%v)", expired, err)
+	}
+	if _, err = m.Restore("restore", NewIDSet("b")); err == nil {
+		t.Fatalf("Expected restoring an expired document to fail")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	if _, err = m.CreateIndex("history"); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	if err = m.SetSettings("history", IndexSettings{HistoryVersions: 2}); err != nil {
+		t.Fatalf("Failed to update settings: %v", err)
+	}
+
+	before, _ := (&Manifest{ID: "m", DocumentIDs: NewIDSet("a")}).Encode()
+	first, err := m.Update("history", NewDocSet(*before, Document{ID: "a", Body: []byte("1")}))
+	if err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	asOf := first.Docs["a"].UpdatedAt
+
+	// the next versions must be written in a later second to be told apart
+	time.Sleep(time.Until(time.Unix(asOf+1, 0)))
+	after, _ := (&Manifest{ID: "m", DocumentIDs: NewIDSet("a", "b")}).Encode()
+	if _, err = m.Update("history", NewDocSet(*after, Document{ID: "a", Body: []byte("2")}, Document{ID: "b"})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	for n := 3; n <= 4; n++ {
+		if _, err = m.Update("history", NewDocSet(Document{ID: "a", Body: []byte(fmt.Sprint(n))})); err != nil {
+			t.Fatalf("Failed to update index: %v", err)
+		}
+	}
+
+	history, err := m.History("history", "a")
+	if err != nil {
+		t.Fatalf("Failed to get history: %v", err)
+	}
+	bodies := []string{}
+	for _, d := range history {
+		bodies = append(bodies, fmt.Sprintf("%v:%s", d.Version, d.Body))
+	}
+	if diff := cmp.Diff([]string{"2:2", "3:3", "4:4"}, bodies); diff != "" {
+		t.Fatalf("Unexpected history: %v", diff)
+	}
+	if _, err = m.GetVersion("history", "a", 1); err == nil {
+		t.Fatalf("Expected pruned version to be gone")
+	}
+	if v, err := m.GetVersion("history", "a", 3); err != nil || string(v.Body) != "3" {
+		t.Fatalf("Failed to get version 3: %v %v", v, err)
+	}
+
+	// the manifest's first version is kept, but the first version of "a" was pruned so it is left out
+	results, err := m.QueryAsOf("history", "m", 0, asOf)
+	if err != nil {
+		t.Fatalf("Failed to query index: %v", err)
+	}
+	expected := NewDocSet(first.Docs["m"])
+	expected.Docs["m"] = Document{ID: "m", Kind: ManifestKind, UpdatedAt: asOf, Version: 1, Body: []byte(`{"a":{}}`), Hash: first.Docs["m"].Hash}
+	expectDocs(t, expected, results)
+
+	if _, err = m.Purge("history", NewIDSet("a")); err != nil {
+		t.Fatalf("Failed to purge document: %v", err)
+	}
+	if _, err = m.Update("history", NewDocSet(Document{ID: "a", Body: []byte("5")})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if history, err = m.History("history", "a"); err != nil || len(history) != 1 || history[0].Version != 1 {
+		t.Fatalf("Expected purged history to be gone, got %v (%v)", history, err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	if _, err = m.CreateIndex("expiry"); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	if err = m.SetSettings("expiry", IndexSettings{DefaultTTLSeconds: 1}); err != nil {
+		t.Fatalf("Failed to update settings: %v", err)
+	}
+
+	manifestDoc, _ := (&Manifest{ID: "m", DocumentIDs: NewIDSet("ttl", "explicit")}).Encode()
+	now := time.Now().Unix()
+	written, err := m.Update("expiry", NewDocSet(*manifestDoc, Document{ID: "ttl"}, Document{ID: "explicit", ExpiresAt: now + 3600}))
+	if err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if written.Docs["m"].ExpiresAt != 0 || written.Docs["ttl"].ExpiresAt != written.Docs["ttl"].UpdatedAt+1 || written.Docs["explicit"].ExpiresAt != now+3600 {
+		t.Fatalf("Unexpected expiry times: %v", written.Docs)
+	}
+	if _, err = m.Update("expiry", NewDocSet(Document{ID: "explicit", ExpiresAt: now})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		results, err := m.Query("expiry", "m", 0)
+		if err != nil {
+			t.Fatalf("Failed to query index: %v", err)
+		}
+		if results.Docs["ttl"].Deleted && results.Docs["explicit"].Deleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected expired documents to be deleted, got %v", results.Docs)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// a document that expired while the worker was not running is read as a tombstone
+	if _, err = m.Update("expiry", NewDocSet(Document{ID: "ttl", Body: []byte("x"), ExpiresAt: now + 3600})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	idx := m.GetIndex("expiry")
+	if err = idx.acquire(); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	err = idx.docs.UpdateMap(func(tx *storeTx) error {
+		d, _ := tx.Get("ttl")
+		d.ExpiresAt = now - 1
+		tx.Set("ttl", d)
+		tx.OnCommit(func() { idx.cache.Add(d) })
+		return nil
+	})
+	idx.release()
+	if err != nil {
+		t.Fatalf("Failed to update store: %v", err)
+	}
+	if doc, err := m.Get("expiry", "ttl"); err != nil || !doc.Deleted || doc.Body != nil {
+		t.Fatalf("Expected an expired document to be read as a tombstone, got %v (%v)", doc, err)
+	}
+	if results, err := m.Query("expiry", "m", 0); err != nil || !results.Docs["ttl"].Deleted {
+		t.Fatalf("Expected an expired document to be queried as a tombstone, got %v (%v)", results, err)
+	}
+	if results, err := idx.LoadDocuments(NewIDSet("ttl"), 0); err != nil || !results.Docs["ttl"].Deleted {
+		t.Fatalf("Expected an expired document to be loaded as a tombstone, got %v (%v)", results, err)
+	}
+}
+
+func TestDocumentMetadata(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	idx, err := m.CreateIndex("metadata")
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+
+	doc := Document{ID: "a", Body: []byte("{}"), ContentType: "application/json; charset=utf-8", Meta: map[string]string{"Owner": "alice", "Tag": "draft"}}
+	if _, err = m.Update("metadata", NewDocSet(doc)); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if !idx.closeIfIdle(time.Now()) {
+		t.Fatalf("Expected the idle index to close")
+	}
+	stored, err := m.Get("metadata", "a")
+	if err != nil {
+		t.Fatalf("Failed to get document: %v", err)
+	}
+	if stored.MediaType() != doc.ContentType || cmp.Diff(doc.Meta, stored.Meta) != "" {
+		t.Fatalf("Expected metadata to be stored, got %v %v", stored.ContentType, stored.Meta)
+	}
+	if (Document{ID: "b"}).MediaType() != DefaultContentType {
+		t.Fatalf("Expected the default content type")
+	}
+
+	for _, invalid := range []Document{
+		{ID: "b", ContentType: "not a type"},
+		{ID: "b", Meta: map[string]string{"Bad Key": "x"}},
+		{ID: "b", Meta: map[string]string{"Key": "line\nbreak"}},
+		{ID: "b", Meta: map[string]string{"owner": "alice", "Owner": "bob"}},
+	} {
+		if _, err = m.Update("metadata", NewDocSet(invalid)); err == nil {
+			t.Fatalf("Expected invalid metadata to be rejected: %v", invalid)
+		}
+	}
+}
+
+func TestPatch(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	if _, err = m.CreateIndex("patch"); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	body := `{"name":"a","count":9007199254740993,"tags":["x","y"],"nested":{"keep":true,"drop":1},"html":"<a>&</a>"}`
+	if _, err = m.Update("patch", NewDocSet(Document{ID: "a", Body: []byte(body)}, Document{ID: "binary", Body: []byte{0xff}})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+
+	patched, err := m.Patch("patch", "a", MergePatchType, []byte(`{"name":"b","nested":{"drop":null}}`))
+	if err != nil {
+		t.Fatalf("Failed to merge patch: %v", err)
+	}
+	expected := `{"count":9007199254740993,"html":"<a>&</a>","name":"b","nested":{"keep":true},"tags":["x","y"]}`
+	if string(patched.Body) != expected || patched.Version != 2 {
+		t.Fatalf("Unexpected merge patch result: %s (version %v)", patched.Body, patched.Version)
+	}
+
+	ops := `[
+		{"op": "test", "path": "/count", "value": 9007199254740993},
+		{"op": "add", "path": "/tags/1", "value": "z"},
+		{"op": "remove", "path": "/tags/0"},
+		{"op": "move", "from": "/name", "path": "/nested/name"},
+		{"op": "copy", "from": "/tags", "path": "/copied"},
+		{"op": "replace", "path": "/count", "value": 1}
+	]`
+	if patched, err = m.Patch("patch", "a", JSONPatchType, []byte(ops)); err != nil {
+		t.Fatalf("Failed to apply JSON Patch: %v", err)
+	}
+	expected = `{"copied":["z","y"],"count":1,"html":"<a>&</a>","nested":{"keep":true,"name":"b"},"tags":["z","y"]}`
+	if string(patched.Body) != expected {
+		t.Fatalf("Unexpected JSON Patch result: %s", patched.Body)
+	}
+
+	// a failed operation leaves the document unchanged
+	failing := `[{"op": "replace", "path": "/count", "value": 2}, {"op": "test", "path": "/count", "value": 3}]`
+	if _, err = m.Patch("patch", "a", JSONPatchType, []byte(failing)); err == nil {
+		t.Fatalf("Expected failed test operation to reject the patch")
+	}
+	if stored, _ := m.Get("patch", "a"); string(stored.Body) != expected {
+		t.Fatalf("Expected rejected patch to leave the document unchanged, got %s", stored.Body)
+	}
+
+	if _, err = m.Patch("patch", "binary", MergePatchType, []byte(`{}`)); err == nil {
+		t.Fatalf("Expected patching a non-JSON body to fail")
+	}
+	if _, err = m.Patch("patch", "missing", MergePatchType, []byte(`{}`)); err == nil {
+		t.Fatalf("Expected patching a missing document to fail")
+	}
+}
+
+func TestDeltaSync(t *testing.T) {
+	base := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 40))
+	target := append([]byte("Prefix! "), base[:600]...)
+	target = append(target, []byte("an edit in the middle")...)
+	target = append(target, base[700:]...)
+	for _, c := range []struct{ base, target []byte }{{base, target}, {base, nil}, {nil, target}, {target, base}} {
+		delta := ComputeDelta(c.base, c.target)
+		applied, err := ApplyDelta(c.base, delta)
+		if err != nil || !bytes.Equal(applied, c.target) {
+			t.Fatalf("Delta did not reproduce the target: %v", err)
+		}
+	}
+	if delta := ComputeDelta(base, target); len(delta) > 100 {
+		t.Fatalf("Expected a small delta, got %v bytes", len(delta))
+	}
+
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	if _, err = m.CreateIndex("delta"); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	if err = m.SetSettings("delta", IndexSettings{HistoryVersions: 1}); err != nil {
+		t.Fatalf("Failed to update settings: %v", err)
+	}
+
+	manifestDoc, _ := (&Manifest{ID: "m", DocumentIDs: NewIDSet("a")}).Encode()
+	if _, err = m.Update("delta", NewDocSet(*manifestDoc, Document{ID: "a", Body: base})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if _, err = m.Update("delta", NewDocSet(Document{ID: "a", Body: target})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+
+	result, err := m.QueryMany("delta", []ManifestQuery{{ManifestID: "m", Known: map[string]int64{"a": 1, "m": 1}}})
+	if err != nil {
+		t.Fatalf("Failed to query index: %v", err)
+	}
+	a := result.Docs["a"]
+	if a.Body != nil || a.BaseVersion != 1 {
+		t.Fatalf("Expected a delta against version 1, got %v", a)
+	}
+	if applied, err := ApplyDelta(base, a.Delta); err != nil || !bytes.Equal(applied, target) {
+		t.Fatalf("Delta did not reproduce the latest version: %v", err)
+	}
+	if result.Docs["m"].Delta != nil {
+		t.Fatalf("Expected manifests to be sent in full")
+	}
+	single, err := m.QueryKnownAs("delta", "", "m", 0, map[string]int64{"a": 1})
+	if err != nil {
+		t.Fatalf("Failed to query index: %v", err)
+	}
+	if applied, err := ApplyDelta(base, single.Docs["a"].Delta); err != nil || single.Docs["a"].BaseVersion != 1 || !bytes.Equal(applied, target) {
+		t.Fatalf("Expected a single manifest query to send a delta against version 1, got %v (%v)", single.Docs["a"], err)
+	}
+	if plain, err := m.Query("delta", "m", 0); err != nil || plain.Docs["a"].Delta != nil || !bytes.Equal(plain.Docs["a"].Body, target) {
+		t.Fatalf("Expected a query without known versions to send bodies, got %v (%v)", plain, err)
+	}
+
+	// a delta sent back on write is ignored
+	if _, err = m.Update("delta", NewDocSet(Document{ID: "a", Body: base, Delta: []byte("junk"), BaseVersion: 1})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	stored, err := m.Get("delta", "a")
+	if err != nil || stored.Delta != nil || stored.BaseVersion != 0 || !bytes.Equal(stored.Body, base) {
+		t.Fatalf("Expected the delta not to be stored, got %v %v", stored, err)
+	}
+	result, err = m.QueryMany("delta", []ManifestQuery{{ManifestID: "m", Known: map[string]int64{"a": 2}}})
+	if err != nil {
+		t.Fatalf("Failed to query index: %v", err)
+	}
+	if applied, err := ApplyDelta(target, result.Docs["a"].Delta); err != nil || result.Docs["a"].BaseVersion != 2 || !bytes.Equal(applied, base) {
+		t.Fatalf("Expected a delta against version 2, got %v %v", result.Docs["a"], err)
+	}
+}
+
+func TestContentAddressedBodies(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	idx, err := m.CreateIndex("bodies")
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+
+	countBodies := func() (count int) {
+		if err := idx.acquire(); err != nil {
+			t.Fatalf("Failed to open index: %v", err)
+		}
+		defer idx.release()
+		idx.docs.ForEach(bodiesSide, "", func(string, []byte) error {
+			count++
+			return nil
+		})
+		return
+	}
+
+	updated, err := m.Update("bodies", NewDocSet(Document{ID: "a", Body: []byte("shared")}, Document{ID: "b", Body: []byte("shared")}))
+	if err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if hash := updated.Docs["a"].Hash; hash != hashBody([]byte("shared")) || updated.Docs["b"].Hash != hash {
+		t.Fatalf("Expected documents to be hashed, got %v", updated.Docs)
+	}
+	if n := countBodies(); n != 1 {
+		t.Fatalf("Expected a shared body to be stored once, found %v", n)
+	}
+
+	if _, err = m.Update("bodies", NewDocSet(Document{ID: "a", Body: []byte("changed")})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if n := countBodies(); n != 2 {
+		t.Fatalf("Expected 2 bodies, found %v", n)
+	}
+	if _, err = m.Update("bodies", NewDocSet(Document{ID: "b", Deleted: true})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if n := countBodies(); n != 1 {
+		t.Fatalf("Expected the unreferenced body to be removed, found %v", n)
+	}
+
+	if !idx.closeIfIdle(time.Now()) {
+		t.Fatalf("Expected the idle index to close")
+	}
+	a, err := m.Get("bodies", "a")
+	if err != nil || string(a.Body) != "changed" || a.Hash != hashBody([]byte("changed")) {
+		t.Fatalf("Expected the body to be loaded from the body area, got %v %v", a, err)
+	}
+	b, err := m.Get("bodies", "b")
+	if err != nil || !b.Deleted || b.Hash != "" {
+		t.Fatalf("Expected a tombstone without a hash, got %v %v", b, err)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+	config.MaxBlobSize = 1 << 20
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	idx, err := m.CreateIndex("blobs")
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+
+	content := bytes.Repeat([]byte("attachment "), 1000)
+	if _, err = m.PutBlob("blobs", "a", bytes.NewReader(content), "text/plain", strings.Repeat("0", 64)); err == nil {
+		t.Fatalf("Expected a checksum mismatch")
+	}
+	if _, err = m.PutBlob("blobs", "a", bytes.NewReader(make([]byte, 2<<20)), "", ""); err == nil {
+		t.Fatalf("Expected an oversized blob to be rejected")
+	}
+	doc, err := m.PutBlob("blobs", "a", bytes.NewReader(content), "text/plain", hashBody(content))
+	if err != nil {
+		t.Fatalf("Failed to put blob: %v", err)
+	}
+	expected := BlobRef{Hash: hashBody(content), Size: int64(len(content)), ContentType: "text/plain"}
+	if doc.Blob == nil || *doc.Blob != expected {
+		t.Fatalf("Unexpected blob reference %v", doc.Blob)
+	}
+
+	f, _, err := m.OpenBlob("blobs", "a")
+	if err != nil {
+		t.Fatalf("Failed to open blob: %v", err)
+	}
+	stored, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || !bytes.Equal(stored, content) {
+		t.Fatalf("Expected the blob to be stored: %v", err)
+	}
+
+	// references can be copied, but must refer to a stored blob
+	if _, err = m.Update("blobs", NewDocSet(Document{ID: "b", Blob: doc.Blob})); err != nil {
+		t.Fatalf("Failed to copy blob reference: %v", err)
+	}
+	missing := BlobRef{Hash: strings.Repeat("a", 64), Size: 1}
+	if _, err = m.Update("blobs", NewDocSet(Document{ID: "c", Blob: &missing})); err == nil {
+		t.Fatalf("Expected a reference to a missing blob to be rejected")
+	}
+
+	if _, err = m.Update("blobs", NewDocSet(Document{ID: "a"}, Document{ID: "b", Deleted: true})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if removed, err := idx.CollectBlobs(0); err != nil || removed != 0 {
+		t.Fatalf("Expected a blob kept for restoring to be kept, removed %v: %v", removed, err)
+	}
+	if _, err = m.Purge("blobs", NewIDSet("b")); err != nil {
+		t.Fatalf("Failed to purge document: %v", err)
+	}
+	if removed, err := idx.CollectBlobs(0); err != nil || removed != 1 {
+		t.Fatalf("Expected the unreferenced blob to be removed, removed %v: %v", removed, err)
+	}
+	if _, _, err = m.OpenBlob("blobs", "a"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("Expected the blob to be gone, got %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	idx, err := m.CreateIndex("compression")
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	if err = m.SetSettings("compression", IndexSettings{HistoryVersions: 1, CompressionThreshold: 100}); err != nil {
+		t.Fatalf("Failed to set settings: %v", err)
+	}
+
+	stored := func(id string) (d Document) {
+		if err := idx.acquire(); err != nil {
+			t.Fatalf("Failed to open index: %v", err)
+		}
+		defer idx.release()
+		idx.docs.DoWithMap(func(m map[string]Document) {
+			d = m[id]
+		})
+		return
+	}
+
+	body := []byte(`{"text":"` + strings.Repeat("compressible ", 100) + `"}`)
+	if _, err = m.Update("compression", NewDocSet(Document{ID: "a", Body: body}, Document{ID: "b", Body: []byte("short")}, Document{ID: "m", Kind: ManifestKind, Body: []byte(`{"a":{}}`)})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if a := stored("a"); a.Encoding != deflateEncoding || len(a.Body) >= len(body) || a.Hash != hashBody(body) {
+		t.Fatalf("Expected the large body to be compressed, got %v bytes encoded as %v", len(a.Body), a.Encoding)
+	}
+	if b := stored("b"); b.Encoding != "" {
+		t.Fatalf("Expected the small body to be left uncompressed")
+	}
+
+	if !idx.closeIfIdle(time.Now()) {
+		t.Fatalf("Expected the idle index to close")
+	}
+	a, err := m.Get("compression", "a")
+	if err != nil || !bytes.Equal(a.Body, body) || a.Encoding != "" {
+		t.Fatalf("Expected the body to be decompressed, got %v", err)
+	}
+
+	patched, err := m.Patch("compression", "a", MergePatchType, []byte(`{"extra":true}`))
+	if err != nil {
+		t.Fatalf("Failed to patch compressed document: %v", err)
+	}
+	if !strings.Contains(string(patched.Body), `"extra":true`) || stored("a").Encoding != deflateEncoding {
+		t.Fatalf("Expected the patched body to be compressed again")
+	}
+	if v, err := m.GetVersion("compression", "a", 1); err != nil || !bytes.Equal(v.Body, body) {
+		t.Fatalf("Expected the previous version to be decompressed, got %v", err)
+	}
+	result, err := m.QueryMany("compression", []ManifestQuery{{ManifestID: "m", Known: map[string]int64{"a": 1}}})
+	if err != nil {
+		t.Fatalf("Failed to query index: %v", err)
+	}
+	if applied, err := ApplyDelta(body, result.Docs["a"].Delta); err != nil || !bytes.Equal(applied, patched.Body) {
+		t.Fatalf("Expected a delta against the decompressed version: %v", err)
+	}
+
+	if err = m.SetSettings("compression", IndexSettings{}); err != nil {
+		t.Fatalf("Failed to set settings: %v", err)
+	}
+	if rewritten, err := m.Recompress("compression"); err != nil || rewritten != 2 {
+		t.Fatalf("Expected a document and its previous version to be decompressed, rewrote %v: %v", rewritten, err)
+	}
+	if a := stored("a"); a.Encoding != "" || !bytes.Equal(a.Body, patched.Body) || a.Version != 2 {
+		t.Fatalf("Expected the stored body to be decompressed without a new version")
+	}
+	if err := idx.acquire(); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	bz, err := idx.docs.loadSide(historySide, historyKey("a", 1))
+	idx.release()
+	v1 := storedDocument{}
+	if err != nil || mp.Unmarshal(bz, &v1) != nil || v1.Doc.Encoding != "" || !bytes.Equal(v1.Doc.Body, body) {
+		t.Fatalf("Expected the previous version to be decompressed, got %v", err)
+	}
+
+	// a body that cannot be decoded is an error, not an empty document
+	if err := idx.acquire(); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	err = idx.docs.UpdateMap(func(tx *storeTx) error {
+		d, _ := tx.Get("a")
+		d.Body, d.Encoding = []byte("not deflated"), deflateEncoding
+		tx.Set("a", d)
+		return nil
+	})
+	idx.release()
+	if err != nil || !idx.closeIfIdle(time.Now()) {
+		t.Fatalf("Failed to corrupt document: %v", err)
+	}
+	if _, err = m.Get("compression", "a"); err == nil {
+		t.Fatalf("Expected an undecodable document to fail to load")
+	}
+	if _, err = m.Query("compression", "m", 0); err == nil {
+		t.Fatalf("Expected a query of an undecodable document to fail")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	oldKey := bytes.Repeat([]byte{1}, MasterKeySize)
+	newKey := bytes.Repeat([]byte{2}, MasterKeySize)
+	open := func(key []byte, previous ...[]byte) (*MCache, error) {
+		config := DefaultConfig
+		config.DataDir = testDataDir
+		config.MasterKey = key
+		config.PreviousMasterKeys = previous
+		m, err := NewMCache(config)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = m.CreateIndex("encrypted"); err != nil {
+			m.Close(context.Background())
+			return nil, err
+		}
+		return m, nil
+	}
+
+	if _, err := open([]byte("short")); err == nil {
+		t.Fatalf("Expected an invalid master key to be rejected")
+	}
+	m, err := open(oldKey)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	body := []byte("a secret body that should not be stored in plaintext")
+	if err = m.SetSettings("encrypted", IndexSettings{HistoryVersions: 1}); err != nil {
+		t.Fatalf("Failed to update settings: %v", err)
+	}
+	manifestDoc, _ := (&Manifest{ID: "m", DocumentIDs: NewIDSet("a", "secret-member")}).Encode()
+	updated, err := m.Update("encrypted", NewDocSet(Document{ID: "a", Body: body}, *manifestDoc))
+	if err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if updated.Docs["a"].Hash == hashBody(body) {
+		t.Fatalf("Expected the hash of an encrypted body to be keyed")
+	}
+	manifestDoc, _ = (&Manifest{ID: "m", DocumentIDs: NewIDSet("a", "secret-member", "secret-other")}).Encode()
+	if _, err = m.Update("encrypted", NewDocSet(*manifestDoc)); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	m.Close(context.Background())
+
+	file, err := ioutil.ReadFile(testDataDir + "/" + indexFilenamePrefix + "encrypted" + indexFilenameSuffix)
+	if err != nil {
+		t.Fatalf("Failed to read index file: %v", err)
+	}
+	if bytes.Contains(file, []byte("secret body")) {
+		t.Fatalf("Expected the body to be encrypted in the index file")
+	}
+	if bytes.Contains(file, []byte("secret-member")) {
+		t.Fatalf("Expected manifest bodies to be encrypted in the index file")
+	}
+	if _, err = open(nil); err == nil || !strings.Contains(err.Error(), "no master key") {
+		t.Fatalf("Expected an encrypted index to be refused without a master key, got %v", err)
+	}
+	if _, err = open(newKey); err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Fatalf("Expected an encrypted index to be refused with the wrong master key, got %v", err)
+	}
+
+	// rotating the master key re-wraps the data key, so the old key can be retired
+	if m, err = open(newKey, oldKey); err != nil {
+		t.Fatalf("Failed to open mcache with a rotated key: %v", err)
+	}
+	if checked, err := m.RewrapKeys(); err != nil || checked != 1 {
+		t.Fatalf("Expected one index to be checked, checked %v: %v", checked, err)
+	}
+	m.Close(context.Background())
+	if m, err = open(newKey); err != nil {
+		t.Fatalf("Failed to open mcache with the new key: %v", err)
+	}
+	defer m.Close(context.Background())
+	a, err := m.Get("encrypted", "a")
+	if err != nil || !bytes.Equal(a.Body, body) || a.Hash != updated.Docs["a"].Hash {
+		t.Fatalf("Expected the body to be decrypted, got %v %v", a, err)
+	}
+	results, err := m.Query("encrypted", "m", 0)
+	if err != nil || string(results.Docs["m"].Body) != `{"a":{},"secret-member":{},"secret-other":{}}` || !bytes.Equal(results.Docs["a"].Body, body) {
+		t.Fatalf("Expected the manifest to be decrypted, got %v %v", results, err)
+	}
+	if containing, err := m.ManifestsContaining("encrypted", "secret-other"); err != nil || !cmp.Equal(NewIDSet("m"), containing) {
+		t.Fatalf("Expected the membership of encrypted manifests to be indexed, got %v %v", containing, err)
+	}
+	history, err := m.History("encrypted", "m")
+	if err != nil || len(history) != 2 || string(history[0].Body) != `{"a":{},"secret-member":{}}` {
+		t.Fatalf("Expected previous manifest versions to be decrypted, got %v %v", history, err)
+	}
+
+	// an index written before a master key was configured is encrypted when it is next opened
+	plainDir := testDataDir + "/plain"
+	defer os.RemoveAll(plainDir)
+	config := DefaultConfig
+	config.DataDir = plainDir
+	plain, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	if _, err = plain.CreateIndex("plain"); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	if _, err = plain.Update("plain", NewDocSet(Document{ID: "a", Body: body}, *manifestDoc)); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	plain.Close(context.Background())
+	config.MasterKey = newKey
+	if plain, err = NewMCache(config); err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	results, err = plain.Query("plain", "m", 0)
+	plain.Close(context.Background())
+	if err != nil || !bytes.Equal(results.Docs["a"].Body, body) || results.Docs["a"].Hash == hashBody(body) {
+		t.Fatalf("Expected the migrated index to be readable with keyed hashes, got %v %v", results, err)
+	}
+	if file, err = ioutil.ReadFile(plainDir + "/" + indexFilenamePrefix + "plain" + indexFilenameSuffix); err != nil {
+		t.Fatalf("Failed to read index file: %v", err)
+	}
+	if bytes.Contains(file, []byte("secret body")) || bytes.Contains(file, []byte("secret-member")) {
+		t.Fatalf("Expected the existing documents to be encrypted in the index file")
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	if _, err = m.CreateIndex("source"); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	if err = m.SetSettings("source", IndexSettings{HistoryVersions: 3}); err != nil {
+		t.Fatalf("Failed to set settings: %v", err)
+	}
+	if _, err = m.Update("source", NewDocSet(Document{ID: "a", Body: []byte("original")}, Document{ID: "m", Kind: ManifestKind, Body: []byte(`{"a":{},"b":{}}`)})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if _, err = m.PutBlob("source", "b", strings.NewReader("attached"), "text/plain", ""); err != nil {
+		t.Fatalf("Failed to put blob: %v", err)
+	}
+
+	archive := &bytes.Buffer{}
+	info, err := m.Snapshot("source", archive)
+	if err != nil || info.IndexID != "source" || len(info.Blobs) != 1 {
+		t.Fatalf("Failed to snapshot index: %v %v", info, err)
+	}
+	snapshot := archive.Bytes()
+	if leftover, _ := filepath.Glob(testDataDir + "/snapshot-*"); len(leftover) != 0 {
+		t.Fatalf("Expected the snapshot's temporary copy to be removed, found %v", leftover)
+	}
+
+	if _, err = m.RestoreSnapshot("copy", bytes.NewReader(snapshot), false); err != nil {
+		t.Fatalf("Failed to restore snapshot: %v", err)
+	}
+	expected, _ := m.Query("source", "m", 0)
+	restored, err := m.Query("copy", "m", 0)
+	if err != nil {
+		t.Fatalf("Failed to query restored index: %v", err)
+	}
+	expectDocs(t, expected, restored)
+	if settings, err := m.Settings("copy"); err != nil || settings.HistoryVersions != 3 {
+		t.Fatalf("Expected settings to be restored, got %v %v", settings, err)
+	}
+	f, _, err := m.OpenBlob("copy", "b")
+	if err != nil {
+		t.Fatalf("Failed to open restored blob: %v", err)
+	}
+	f.Close()
+
+	if _, err = m.Update("copy", NewDocSet(Document{ID: "a", Body: []byte("changed")})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if _, err = m.RestoreSnapshot("copy", bytes.NewReader(snapshot), false); err == nil {
+		t.Fatalf("Expected an existing index not to be replaced")
+	}
+	if _, err = m.RestoreSnapshot("copy", bytes.NewReader(snapshot), true); err != nil {
+		t.Fatalf("Failed to replace index: %v", err)
+	}
+	if a, err := m.Get("copy", "a"); err != nil || string(a.Body) != "original" {
+		t.Fatalf("Expected the replaced index to hold the snapshot, got %v %v", a, err)
+	}
+	if _, err = m.RestoreSnapshot("broken", bytes.NewReader(snapshot[:len(snapshot)/2]), false); err == nil {
+		t.Fatalf("Expected a truncated snapshot to be refused")
+	}
+
+	paths, err := m.SnapshotAll(testDataDir + "/snapshots")
+	if err != nil || len(paths) != 2 {
+		t.Fatalf("Expected a snapshot of each index, got %v %v", paths, err)
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+	logs := &bytes.Buffer{}
+	config.LogOutput = logs
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	// logs go to LogOutput, so commands can keep them out of an export written to stdout
+	if !strings.Contains(logs.String(), "Scanned path") {
+		t.Fatalf("Expected logs to be written to LogOutput, got %q", logs.String())
+	}
+	for _, id := range []string{"source", "preserved", "restamped"} {
+		if _, err = m.CreateIndex(id); err != nil {
+			t.Fatalf("Failed to open index: %v", err)
+		}
+	}
+	if err = m.SetSettings("source", IndexSettings{HistoryVersions: 3, CompressionThreshold: 1}); err != nil {
+		t.Fatalf("Failed to set settings: %v", err)
+	}
+	if err = m.SetSettings("preserved", IndexSettings{HistoryVersions: 3}); err != nil {
+		t.Fatalf("Failed to set settings: %v", err)
+	}
+	for _, body := range []string{"first", "second", "third"} {
+		if _, err = m.Update("source", NewDocSet(Document{ID: "a", Body: []byte(body)}, Document{ID: "m", Kind: ManifestKind, Body: []byte(`{"a":{},"c":{}}`)})); err != nil {
+			t.Fatalf("Failed to update index: %v", err)
+		}
+	}
+	if _, err = m.Update("source", NewDocSet(Document{ID: "c", Body: []byte("deleted")})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	if _, err = m.SoftDelete("source", NewIDSet("c")); err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+
+	export := &bytes.Buffer{}
+	records, err := m.Export("source", export)
+	if err != nil {
+		t.Fatalf("Failed to export index: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(export.String()), "\n")
+	// a has 2 previous versions, m has 2 and c has 1
+	if records != 8 || len(lines) != records {
+		t.Fatalf("Expected 8 records, got %v in %v lines", records, len(lines))
+	}
+
+	result, err := m.Import("preserved", bytes.NewReader(export.Bytes()), ImportOptions{PreserveUpdatedAt: true})
+	if err != nil || result != (ImportResult{Documents: 3, Versions: 5}) {
+		t.Fatalf("Failed to import index: %v %v", result, err)
+	}
+	expected, _ := m.GetAll("source")
+	imported, err := m.GetAll("preserved")
+	if err != nil {
+		t.Fatalf("Failed to get imported documents: %v", err)
+	}
+	expectDocs(t, expected, imported)
+	if c := imported.Docs["c"]; !c.Deleted {
+		t.Fatalf("Expected tombstone to be imported, got %v", c)
+	}
+	expectedHistory, _ := m.History("source", "a")
+	history, err := m.History("preserved", "a")
+	if err != nil {
+		t.Fatalf("Failed to get imported history: %v", err)
+	}
+	if diff := cmp.Diff(expectedHistory, history); diff != "" {
+		t.Fatalf("Unexpected imported history (-want +got):\n%s", diff)
+	}
+
+	result, err = m.Import("restamped", bytes.NewReader(export.Bytes()), ImportOptions{})
+	if err != nil || result != (ImportResult{Documents: 3, Skipped: 5}) {
+		t.Fatalf("Failed to import index: %v %v", result, err)
+	}
+	a, err := m.Get("restamped", "a")
+	if err != nil || string(a.Body) != "third" || a.Version != 1 {
+		t.Fatalf("Expected the current version to be imported as a new document, got %v %v", a, err)
+	}
+
+	old := `{"type":"document","doc":{"id":"old","body":"b2xk","updatedAt":1000,"version":7}}`
+	if _, err = m.Import("preserved", strings.NewReader(old), ImportOptions{PreserveUpdatedAt: true}); err != nil {
+		t.Fatalf("Failed to import document: %v", err)
+	}
+	if d, err := m.Get("preserved", "old"); err != nil || d.UpdatedAt != 1000 || d.Version != 7 || string(d.Body) != "old" {
+		t.Fatalf("Expected UpdatedAt and Version to be preserved, got %v %v", d, err)
+	}
+	if _, err = m.Import("preserved", strings.NewReader(old), ImportOptions{PreserveUpdatedAt: true}); err == nil || !strings.Contains(err.Error(), "not newer") {
+		t.Fatalf("Expected a version that is not newer than the stored one to be rejected, got %v", err)
+	}
+
+	blobbed := `{"type":"document","doc":{"id":"blobbed","blob":{"hash":"` + strings.Repeat("ab", 32) + `","size":3}}}`
+	result, err = m.Import("restamped", strings.NewReader(blobbed), ImportOptions{})
+	if err != nil || result != (ImportResult{Documents: 1, MissingBlobs: 1}) {
+		t.Fatalf("Expected the missing blob to be dropped, got %v %v", result, err)
+	}
+	if d, err := m.Get("restamped", "blobbed"); err != nil || d.Blob != nil {
+		t.Fatalf("Expected the document to be imported without its blob, got %v %v", d, err)
+	}
+	if _, err = m.Import("preserved", strings.NewReader(`{"type":"unknown","doc":{"id":"x"}}`), ImportOptions{}); err == nil || !strings.HasPrefix(err.Error(), "Invalid import") {
+		t.Fatalf("Expected an unknown record type to be rejected, got %v", err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	os.MkdirAll(testDataDir, 0700)
+	certFile, keyFile := writeTestCert(t, "first")
+	caFile := testDataDir + "/ca.pem"
+	certPEM, _ := ioutil.ReadFile(certFile)
+	ioutil.WriteFile(caFile, certPEM, 0600)
+
+	partial := []Config{
+		{TLSCertFile: certFile},
+		{TLSKeyFile: keyFile},
+		{TLSClientCAFile: caFile},
+	}
+	for _, config := range partial {
+		config.DataDir = testDataDir
+		if _, err := NewMCache(config); err == nil || !strings.HasPrefix(err.Error(), "Invalid TLS configuration") {
+			t.Fatalf("Expected partial TLS configuration %+v to be rejected, got %v", config, err)
+		}
+	}
+
+	tlsConfig, err := NewTLSConfig(Config{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: caFile})
+	if err != nil {
+		t.Fatalf("Failed to configure TLS: %v", err)
+	}
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert || tlsConfig.ClientCAs == nil {
+		t.Fatalf("Expected client certificates to be required")
+	}
+	cert, err := tlsConfig.GetCertificate(nil)
+	if err != nil || cert == nil {
+		t.Fatalf("Failed to get certificate: %v", err)
+	}
+	if _, err = NewTLSConfig(Config{TLSCertFile: certFile, TLSKeyFile: certFile}); err == nil {
+		t.Fatalf("Expected an invalid key to be rejected")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	os.MkdirAll(testDataDir, 0700)
+	certFile, keyFile := writeTestCert(t, "first")
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	first, _ := r.GetCertificate(nil)
+
+	writeTestCert(t, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if cert, _ := r.GetCertificate(nil); cert != first {
+		t.Fatalf("Expected the certificate not to be checked again within the reload interval")
+	}
+
+	r.lastChecked = time.Time{}
+	second, err := r.GetCertificate(nil)
+	if err != nil || second == first {
+		t.Fatalf("Expected the changed certificate to be reloaded, got %v", err)
+	}
+
+	ioutil.WriteFile(keyFile, []byte("corrupt"), 0600)
+	evenLater := later.Add(time.Minute)
+	os.Chtimes(keyFile, evenLater, evenLater)
+	r.lastChecked = time.Time{}
+	if cert, err := r.GetCertificate(nil); err != nil || cert != second {
+		t.Fatalf("Expected the previous certificate to be kept when reloading fails, got %v", err)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for `name` and its key to the test data directory
+func writeTestCert(t *testing.T, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	certFile, keyFile = testDataDir+"/cert.pem", testDataDir+"/key.pem"
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return
+}
+
+func TestDocStore(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	os.MkdirAll(testDataDir, 0700)
+	path := testDataDir + "/store.db"
+
+	s, err := openDocStore(path, "store")
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	if err = s.UpdateMap(func(tx *storeTx) error {
+		tx.Set("a", Document{ID: "a", Body: []byte("shared")})
+		tx.Set("b", Document{ID: "b", Body: []byte("shared")})
+		tx.Set("c", Document{ID: "c", Body: []byte("removed")})
+		tx.Put("side", "k1", []byte("v1"))
+		tx.Put("side", "k2", []byte("v2"))
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to write store: %v", err)
+	}
+	if err = s.UpdateMap(func(tx *storeTx) error {
+		tx.Delete("c")
+		tx.Remove("side", "k2")
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to write store: %v", err)
+	}
+	if bz, err := s.Load(bodiesSide, hashBody([]byte("removed"))); err != nil || bz != nil {
+		t.Fatalf("Expected an unreferenced body to be removed, got %v %v", bz, err)
+	}
+
+	// a failed transaction writes nothing and runs none of its commit hooks
+	committed := false
+	if err = s.UpdateMap(func(tx *storeTx) error {
+		tx.Set("a", Document{ID: "a", Body: []byte("rolled back")})
+		tx.Delete("b")
+		tx.Put("side", "k3", []byte("v3"))
+		tx.OnCommit(func() { committed = true })
+		return fmt.Errorf("Failed")
+	}); err == nil || committed {
+		t.Fatalf("Expected the transaction to fail without committing, got %v", err)
+	}
+	s.DoWithMap(func(m map[string]Document) {
+		if len(m) != 2 || string(m["a"].Body) != "shared" {
+			t.Fatalf("Expected a failed transaction to leave the documents unchanged, got %v", m)
+		}
+	})
+	if bz, err := s.Load("side", "k3"); err != nil || bz != nil {
+		t.Fatalf("Expected a failed transaction to leave side buckets unchanged, got %v %v", bz, err)
+	}
+	if bz, err := s.Load(bodiesSide, hashBody([]byte("rolled back"))); err != nil || bz != nil {
+		t.Fatalf("Expected a failed transaction not to store its bodies, got %v %v", bz, err)
+	}
+
+	// a new body is referenced once, and removed with the last document that refers to it
+	if err = s.UpdateMap(func(tx *storeTx) error {
+		tx.Set("d", Document{ID: "d", Body: []byte("own")})
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to write store: %v", err)
+	}
+	if bz, err := s.Load(bodyRefsSide, hashBody([]byte("own"))); err != nil || len(bz) != 8 || bz[7] != 1 {
+		t.Fatalf("Expected a new body to be referenced once, got %v %v", bz, err)
+	}
+	if err = s.UpdateMap(func(tx *storeTx) error {
+		tx.Delete("d")
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to write store: %v", err)
+	}
+	if bz, err := s.Load(bodiesSide, hashBody([]byte("own"))); err != nil || bz != nil {
+		t.Fatalf("Expected the deleted document's body to be removed, got %v %v", bz, err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatalf("Failed to close store: %v", err)
+	}
+	if _, err = s.Load("side", "k1"); err == nil {
+		t.Fatalf("Expected reads from a closed store to fail")
+	}
+	if err = s.ForEach("side", "", func(string, []byte) error { return nil }); err == nil {
+		t.Fatalf("Expected reads from a closed store to fail")
+	}
+	if _, err = s.beginRead(); err == nil {
+		t.Fatalf("Expected reads from a closed store to fail")
+	}
+	if err = s.UpdateMap(func(tx *storeTx) error { return nil }); err == nil {
+		t.Fatalf("Expected writes to a closed store to fail")
+	}
+
+	s, err = openDocStore(path, "store")
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer s.Close()
+	s.DoWithMap(func(m map[string]Document) {
+		expected := map[string]Document{
+			"a": {ID: "a", Body: []byte("shared")},
+			"b": {ID: "b", Body: []byte("shared")},
+		}
+		if diff := cmp.Diff(expected, m); diff != "" {
+			t.Fatalf("Unexpected reopened documents (-want +got):\n%s", diff)
+		}
+	})
+	side := map[string]string{}
+	if err = s.ForEach("side", "k", func(k string, bz []byte) error {
+		side[k] = string(bz)
+		return nil
+	}); err != nil || !cmp.Equal(map[string]string{"k1": "v1"}, side) {
+		t.Fatalf("Unexpected reopened side bucket: %v %v", side, err)
+	}
+	if bz, err := s.Load(bodyRefsSide, hashBody([]byte("shared"))); err != nil || len(bz) != 8 || bz[7] != 2 {
+		t.Fatalf("Expected a shared body to be referenced twice, got %v %v", bz, err)
+	}
+}
+
+func TestIndexConsistency(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+	// a tiny cache keeps documents moving between the cache and the store
+	config.CacheBytes = 3 * documentSize(Document{ID: "a", Body: []byte("0000")})
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+	idx, err := m.CreateIndex("consistency")
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+
+	manifestDoc, _ := (&Manifest{ID: "m", DocumentIDs: NewIDSet("a", "b")}).Encode()
+	if _, err = idx.Update(NewDocSet(*manifestDoc)); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+
+	const writes = 200
+	const readers = 4
+	done := make(chan struct{})
+	errs := make(chan error, readers+1)
+
+	go func() {
+		defer close(done)
+		for n := 0; n < writes; n++ {
+			body := []byte(fmt.Sprintf("%04d", n))
+			if _, err := idx.Update(NewDocSet(Document{ID: "a", Body: body}, Document{ID: "b", Body: body})); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	for r := 0; r < readers; r++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				results, err := idx.Query("m", 0)
+				if err != nil {
+					errs <- err
+					return
+				}
+				a, b := results.Docs["a"], results.Docs["b"]
+				if string(a.Body) != string(b.Body) {
+					errs <- fmt.Errorf("Inconsistent read: a=%q b=%q", a.Body, b.Body)
+					return
+				}
+			}
+		}()
+	}
+
+	for r := 0; r < readers+1; r++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMCacheClose(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	if _, err = m.CreateIndex("close"); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	stored, err := m.Update("close", NewDocSet(Document{ID: "a", Body: []byte("A")}))
+	if err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+
+	if err = m.Close(context.Background()); err != nil {
+		t.Fatalf("Failed to close mcache: %v", err)
+	}
+	if _, err = m.Update("close", NewDocSet(Document{ID: "b"})); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed after close, got %v", err)
+	}
+
+	m, err = NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+
+	results, err := m.GetAll("close")
+	if err != nil {
+		t.Fatalf("Failed to get documents: %v", err)
+	}
+	expectDocs(t, stored, results)
+}
+
+func TestIndexManagerOpenLimit(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+	config.MaxOpenIndexes = 2
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+
+	stored := map[string]*DocSet{}
+	for _, id := range []string{"x", "y", "z"} {
+		if _, err = m.CreateIndex(id); err != nil {
+			t.Fatalf("Failed to open index %v: %v", id, err)
+		}
+		stored[id], err = m.Update(id, NewDocSet(Document{ID: id, Body: []byte(id)}))
+		if err != nil {
+			t.Fatalf("Failed to update index %v: %v", id, err)
+		}
+		if count := m.im.OpenCount(); count > config.MaxOpenIndexes {
+			t.Fatalf("Expected at most %v open indexes, found %v", config.MaxOpenIndexes, count)
+		}
+	}
+
+	if m.GetIndex("x").IsOpen() {
+		t.Fatalf("Expected least recently used index to be closed")
+	}
+
+	results, err := m.GetAll("x")
+	if err != nil {
+		t.Fatalf("Failed to reopen index: %v", err)
+	}
+	expectDocs(t, stored["x"], results)
+}
+
+func TestWarmCache(t *testing.T) {
+	os.RemoveAll(testDataDir)
+	defer os.RemoveAll(testDataDir)
+	config := DefaultConfig
+	config.DataDir = testDataDir
+
+	m, err := NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to open mcache: %v", err)
+	}
+	manifestDoc, _ := (&Manifest{ID: "m", DocumentIDs: NewIDSet("a")}).Encode()
+	if _, err = m.CreateIndex("warm"); err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	if _, err = m.Update("warm", NewDocSet(*manifestDoc, Document{ID: "a"}, Document{ID: "b"})); err != nil {
+		t.Fatalf("Failed to update index: %v", err)
+	}
+	m.Close(context.Background())
+
+	config.WarmCache = true
+	m, err = NewMCache(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen mcache: %v", err)
+	}
+	defer m.Close(context.Background())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		warmup, ok := m.Status().Warmups["warm"]
+		if ok && warmup.State == WarmupDone {
+			if warmup.Loaded != 3 || warmup.Total != 3 {
+				t.Fatalf("Expected 3 documents to be warmed up, got %+v", warmup)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for warm-up, status: %+v", m.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if diff := cmp.Diff(NewIDSet("a", "b", "m"), m.GetIndex("warm").LRUKeys()); diff != "" {
+		t.Fatalf("LRU keys mismatch (-expected +actual):\n%s", diff)
+	}
+}
+
+func TestSharedCacheFairness(t *testing.T) {
+	body := make([]byte, 1000)
+	cache := NewSharedCache(2*documentSize(Document{ID: "cold-00", Body: body}) + 18*documentSize(Document{ID: "hot-00", Body: body}))
+	hot := cache.ForIndex("hot")
+	cold := cache.ForIndex("cold")
+
+	cold.Add(Document{ID: "cold-00", Body: body})
+	cold.Add(Document{ID: "cold-01", Body: body})
+	for n := 0; n < 100; n++ {
+		hot.Add(Document{ID: fmt.Sprintf("hot-%02d", n), Body: body})
+	}
+
+	if len(cold.Keys()) != 2 {
+		t.Fatalf("Expected cold index documents to stay cached, found %v", cold.Keys())
+	}
+	if len(hot.Keys()) != 18 {
+		t.Fatalf("Expected hot index to use the rest of the budget, found %v documents", len(hot.Keys()))
+	}
+	if _, ok := hot.Get("hot-99"); !ok {
+		t.Fatalf("Expected most recent hot document to be cached")
+	}
+}
+
+var cachePolicies = []string{CachePolicyLRU, CachePolicy2Q, CachePolicyARC, CachePolicyNone}
+
+func TestCachePolicies(t *testing.T) {
+	for _, policy := range cachePolicies {
+		config := DefaultConfig
+		config.CachePolicy = policy
+		newCache, err := NewCacheFactory(config)
+		if err != nil {
+			t.Fatalf("Failed to create %v cache factory: %v", policy, err)
+		}
+		cache, err := newCache("policy")
+		if err != nil {
+			t.Fatalf("Failed to create %v cache: %v", policy, err)
+		}
+
+		doc := Document{ID: "a", Body: []byte("A")}
+		cache.Add(doc)
+		cached, ok := cache.Get("a")
+		if policy == CachePolicyNone {
+			if ok || len(cache.Keys()) != 0 {
+				t.Fatalf("Expected %v cache to stay empty", policy)
+			}
+			continue
+		}
+		if !ok || !cmp.Equal(doc, cached) {
+			t.Fatalf("Expected %v cache to return %+v, got %+v", policy, doc, cached)
+		}
+		cache.Remove("a")
+		if _, ok = cache.Get("a"); ok {
+			t.Fatalf("Expected %v cache to remove document", policy)
+		}
+	}
+
+	config := DefaultConfig
+	config.CachePolicy = "fifo"
+	if _, err := NewCacheFactory(config); err == nil {
+		t.Fatalf("Expected unknown cache policy to be rejected")
+	}
+
+	// the deprecated LRUCacheSize keeps selecting the 2Q cache it used to size
+	config = DefaultConfig
+	config.LRUCacheSize = 5
+	newCache, err := NewCacheFactory(config)
+	if err != nil {
+		t.Fatalf("Failed to create cache factory: %v", err)
+	}
+	cache, err := newCache("policy")
+	if twoQueue, ok := cache.(*twoQueueCache); err != nil || !ok || twoQueue.size != 5 {
+		t.Fatalf("Expected a 2Q cache of 5 documents, got %v %v", cache, err)
+	}
+}
+
+// BenchmarkCachePolicies simulates many users each syncing their own small manifest
+func BenchmarkCachePolicies(b *testing.B) {
+	const users = 1000
+	const docsPerUser = 10
+
+	for _, policy := range cachePolicies {
+		b.Run(policy, func(b *testing.B) {
+			os.RemoveAll(testDataDir)
+			defer os.RemoveAll(testDataDir)
+			os.MkdirAll(testDataDir, 0700)
+			config := DefaultConfig
+			config.CachePolicy = policy
+			config.CacheBytes = 1 << 20
+			config.CacheEntries = users * docsPerUser / 4
+			newCache, err := NewCacheFactory(config)
+			if err != nil {
+				b.Fatalf("Failed to create cache factory: %v", err)
+			}
+			idx := NewIndex("bench", testDataDir+"/bench.db", newCache, config)
+			defer idx.Close()
+
+			docs := NewDocSet()
+			for u := 0; u < users; u++ {
+				manifest := &Manifest{ID: fmt.Sprintf("m:%v", u), DocumentIDs: IDSet{}}
+				for d := 0; d < docsPerUser; d++ {
+					id := fmt.Sprintf("%v:%v", u, d)
+					manifest.Add(id)
+					docs.Add(Document{ID: id, Body: make([]byte, 256)})
+				}
+				manifestDoc, _ := manifest.Encode()
+				docs.Add(*manifestDoc)
+			}
+			if _, err = idx.Update(docs); err != nil {
+				b.Fatalf("Failed to update index: %v", err)
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				// a few active users sync much more often than everyone else
+				u := n % users
+				if n%2 == 0 {
+					u = n % (users / 20)
+				}
+				if _, err = idx.Query(fmt.Sprintf("m:%v", u), 0); err != nil {
+					b.Fatalf("Failed to query index: %v", err)
+				}
+			}
+		})
+	}
+}
+
 func expectDocs(t *testing.T, expected *DocSet, actual *DocSet) {
 	if diff := cmp.Diff(expected, actual); diff != "" {
 		panic("Documents mismatch (-expected +actual):\n%s" + diff)
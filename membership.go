@@ -0,0 +1,104 @@
+package mcache
+
+import "fmt"
+
+// membershipIndex maps each document ID to the IDs of the manifests that directly include it.
+// It belongs to an open index's store and is only read or modified while holding the store's lock.
+type membershipIndex map[string]IDSet
+
+// buildMembershipIndex decodes every live manifest in the store, decrypting them with `cipher`, to build its membership index
+func buildMembershipIndex(docs *docStore, cipher *bodyCipher) (membership membershipIndex, err error) {
+	membership = membershipIndex{}
+	docs.DoWithMap(func(m map[string]Document) {
+		for id, d := range m {
+			ids, decodeErr := liveManifestIDs(d, cipher)
+			if decodeErr != nil {
+				err = fmt.Errorf("Unable to decode manifest %v: %v", id, decodeErr)
+				return
+			}
+			membership.update(id, nil, ids)
+		}
+	})
+	return
+}
+
+// update replaces the members recorded for a manifest, `before`, with its new members, `after`
+func (x membershipIndex) update(manifestID string, before, after IDSet) {
+	for id := range before {
+		if _, ok := after[id]; ok {
+			continue
+		}
+		delete(x[id], manifestID)
+		if len(x[id]) == 0 {
+			delete(x, id)
+		}
+	}
+	for id := range after {
+		if x[id] == nil {
+			x[id] = IDSet{}
+		}
+		x[id][manifestID] = SetEntry{}
+	}
+}
+
+// containing returns the IDs of every manifest that includes the document, directly or through other manifests
+func (x membershipIndex) containing(docID string) IDSet {
+	found := IDSet{}
+	queue := []string{docID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for manifestID := range x[id] {
+			if _, seen := found[manifestID]; seen || manifestID == docID {
+				continue
+			}
+			found[manifestID] = SetEntry{}
+			queue = append(queue, manifestID)
+		}
+	}
+	return found
+}
+
+// membershipChange records the members of a manifest before and after it was written
+type membershipChange struct {
+	manifestID string
+	before     IDSet
+	after      IDSet
+}
+
+// diffMembership returns the membership change caused by replacing `prev` with `d`, or nil if neither is a live manifest
+func diffMembership(prev, d Document, cipher *bodyCipher) (*membershipChange, error) {
+	before, err := liveManifestIDs(prev, cipher)
+	if err != nil {
+		return nil, err
+	}
+	after, err := liveManifestIDs(d, cipher)
+	if err != nil {
+		return nil, err
+	}
+	if before == nil && after == nil {
+		return nil, nil
+	}
+	return &membershipChange{d.ID, before, after}, nil
+}
+
+// liveManifestIDs returns the members of a stored manifest, or nil if the document is not a live manifest
+func liveManifestIDs(d Document, cipher *bodyCipher) (IDSet, error) {
+	if !d.IsManifest() || d.Deleted {
+		return nil, nil
+	}
+	plain, err := decodeStoredBody(cipher, d)
+	if err != nil {
+		return nil, err
+	}
+	return decodeManifestBody(plain.Body)
+}
+
+// ManifestsContaining returns the IDs of every manifest that includes the document, directly or through other manifests
+func (i *Index) ManifestsContaining(docID string) (manifestIDs IDSet, err error) {
+	err = i.view(func(m map[string]Document) error {
+		manifestIDs = i.membership.containing(docID)
+		return nil
+	})
+	return
+}
@@ -0,0 +1,69 @@
+package mcache
+
+import (
+	"fmt"
+	"mime"
+	"net/textproto"
+	"strings"
+)
+
+// DefaultContentType is the media type of documents that do not set one
+const DefaultContentType = "application/octet-stream"
+
+// maxMetaSize limits the total size of a document's metadata keys and values, since they are sent as headers
+const maxMetaSize = 8 << 10
+
+// MediaType returns the document's content type, or the default for its kind if it does not set one
+func (d Document) MediaType() string {
+	if d.ContentType != "" {
+		return d.ContentType
+	}
+	if d.IsManifest() {
+		return "application/json"
+	}
+	return DefaultContentType
+}
+
+// validateMetadata checks that a document's content type is a valid media type and that its metadata can be sent as headers
+func validateMetadata(d *Document) error {
+	if d.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(d.ContentType); err != nil {
+			return fmt.Errorf("Invalid document %v: content type %v is not a valid media type", d.ID, d.ContentType)
+		}
+	}
+
+	size := 0
+	// keys are sent as canonical header names, so keys that differ only by case would collide
+	seen := make(map[string]string, len(d.Meta))
+	for k, v := range d.Meta {
+		if !isHeaderToken(k) {
+			return fmt.Errorf("Invalid document %v: meta key (%v) must be a non-empty header token", d.ID, k)
+		}
+		canonical := textproto.CanonicalMIMEHeaderKey(k)
+		if other, ok := seen[canonical]; ok {
+			return fmt.Errorf("Invalid document %v: meta keys %v and %v differ only by case", d.ID, other, k)
+		}
+		seen[canonical] = k
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("Invalid document %v: meta value for %v cannot contain line breaks", d.ID, k)
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxMetaSize {
+		return fmt.Errorf("Invalid document %v: meta cannot be larger than %v bytes", d.ID, maxMetaSize)
+	}
+	return nil
+}
+
+// isHeaderToken returns true if `s` can be used in an HTTP header name
+func isHeaderToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c >= 127 || c <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+			return false
+		}
+	}
+	return true
+}
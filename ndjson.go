@@ -0,0 +1,220 @@
+package mcache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	mp "github.com/vmihailenco/msgpack"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Record types of an NDJSON export, which holds one record per line
+const (
+	// DocumentRecord is the current version of a document, manifest or tombstone
+	DocumentRecord = "document"
+	// VersionRecord is a previous version of a document kept in the index's history
+	VersionRecord = "version"
+)
+
+// importBatchSize is the number of records imported in each write transaction
+const importBatchSize = 1000
+
+// ExportRecord is a line of an NDJSON export
+type ExportRecord struct {
+	Type string   `json:"type"`
+	Doc  Document `json:"doc"`
+}
+
+// ImportOptions controls how an NDJSON export is imported
+type ImportOptions struct {
+	// PreserveUpdatedAt keeps the UpdatedAt and Version of imported documents instead of restamping them, and imports their previous versions.
+	// Clients never sync a document whose preserved UpdatedAt is earlier than their cursor, so it is meant for importing into new indexes.
+	PreserveUpdatedAt bool `json:"preserveUpdatedAt"`
+}
+
+// ImportResult counts the records of an import
+type ImportResult struct {
+	Documents int `json:"documents"`
+	Versions  int `json:"versions"`
+	// Skipped counts previous versions that were not imported, because UpdatedAt was not preserved or the index keeps no history
+	Skipped int `json:"skipped"`
+	// MissingBlobs counts documents and versions imported without their blob, because it is not stored in the index
+	MissingBlobs int `json:"missingBlobs"`
+}
+
+// Export writes every document of the index to `w` as NDJSON, as of a single transaction, returning the number of records written.
+// Each document is preceded by its kept previous versions, oldest first. Bodies are written decoded, but blobs are not exported.
+func (i *Index) Export(w io.Writer) (records int, err error) {
+	err = i.use(func() error {
+		var btx *bolt.Tx
+		var docs []Document
+		var openErr error
+		i.docs.DoWithMap(func(m map[string]Document) {
+			docs = make([]Document, 0, len(m))
+			for _, d := range m {
+				docs = append(docs, d)
+			}
+			btx, openErr = i.docs.beginRead()
+		})
+		if openErr != nil {
+			return openErr
+		}
+		defer btx.Rollback()
+		sort.Slice(docs, func(a, b int) bool { return docs[a].ID < docs[b].ID })
+
+		forEach := func(side, prefix string, f func(k string, bz []byte) error) error {
+			return i.docs.forEachSideIn(btx, side, prefix, f)
+		}
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		for _, d := range docs {
+			versions, _, err := readHistory(forEach, d.ID)
+			if err != nil {
+				return err
+			}
+			for n, v := range append(versions, d) {
+				exported, err := i.exportVersion(v)
+				if err != nil {
+					return err
+				}
+				record := ExportRecord{VersionRecord, exported}
+				if n == len(versions) {
+					record.Type = DocumentRecord
+				}
+				if err = enc.Encode(record); err != nil {
+					return err
+				}
+				records++
+			}
+		}
+		return bw.Flush()
+	})
+	return
+}
+
+// Import writes the documents of an NDJSON export read from `r` to the index, in batches of importBatchSize records.
+// Documents are restamped as if they were just written, unless `opts.PreserveUpdatedAt` is set, in which case a document
+// that is already stored must be imported with a newer version. Blobs are not exported, so references to blobs that are not
+// stored in the index are dropped before the records are written. If an import fails, the batches before the failing record have already been written.
+func (i *Index) Import(r io.Reader, opts ImportOptions) (result ImportResult, err error) {
+	dec := json.NewDecoder(r)
+	batch := NewDocSet()
+	versions := []Document{}
+
+	flush := func() error {
+		if len(batch.Docs) == 0 && len(versions) == 0 {
+			return nil
+		}
+		imported := 0
+		_, err := i.write(func(tx *storeTx) (*DocSet, error) {
+			if !i.settings.historyEnabled() {
+				return batch, nil
+			}
+			for _, v := range versions {
+				if err := i.importVersion(tx, v); err != nil {
+					return nil, err
+				}
+			}
+			imported = len(versions)
+			return batch, nil
+		}, opts.PreserveUpdatedAt)
+		if err != nil {
+			return err
+		}
+		result.Documents += len(batch.Docs)
+		result.Versions += imported
+		result.Skipped += len(versions) - imported
+		batch = NewDocSet()
+		versions = []Document{}
+		return nil
+	}
+
+	for n := 1; ; n++ {
+		record := ExportRecord{}
+		if err = dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return result, fmt.Errorf("Invalid import: record %v: %v", n, err)
+		}
+		if record.Doc.ID == "" {
+			return result, fmt.Errorf("Invalid import: record %v: missing document ID", n)
+		}
+
+		switch record.Type {
+		case DocumentRecord:
+			// a document may only be written once per batch
+			if _, ok := batch.Docs[record.Doc.ID]; ok {
+				if err = flush(); err != nil {
+					return result, fmt.Errorf("Invalid import: record %v: %v", n, err)
+				}
+			}
+			if i.dropMissingBlob(&record.Doc) {
+				result.MissingBlobs++
+			}
+			batch.Add(record.Doc)
+		case VersionRecord:
+			if !opts.PreserveUpdatedAt {
+				result.Skipped++
+				continue
+			}
+			if record.Doc.Version <= 0 {
+				return result, fmt.Errorf("Invalid import: record %v: version of %v must be positive", n, record.Doc.ID)
+			}
+			if i.dropMissingBlob(&record.Doc) {
+				result.MissingBlobs++
+			}
+			versions = append(versions, record.Doc)
+		default:
+			return result, fmt.Errorf("Invalid import: record %v: unknown type %v", n, record.Type)
+		}
+
+		if len(batch.Docs)+len(versions) >= importBatchSize {
+			if err = flush(); err != nil {
+				return result, fmt.Errorf("Invalid import: record %v: %v", n, err)
+			}
+		}
+	}
+	if err = flush(); err != nil {
+		return result, fmt.Errorf("Invalid import: %v", err)
+	}
+	return result, nil
+}
+
+// dropMissingBlob clears the blob of an imported document if the blob is not stored in the index, returning true if it did
+func (i *Index) dropMissingBlob(d *Document) bool {
+	if d.Blob == nil || d.Deleted {
+		return false
+	}
+	if isBlobHash(d.Blob.Hash) {
+		if info, err := os.Stat(i.blobPath(d.Blob.Hash)); err == nil && info.Size() == d.Blob.Size {
+			return false
+		}
+	}
+	d.Blob = nil
+	return true
+}
+
+// importVersion stores a previous version of a document in the index's history, as it was written
+func (i *Index) importVersion(tx *storeTx, v Document) error {
+	if v.Kind == "" {
+		v.Kind = DocumentKind
+	}
+	v.Delta, v.BaseVersion = nil, 0
+	if err := i.checkBlob(&v); err != nil {
+		return err
+	}
+	stored, err := i.encodeDocument(v)
+	if err != nil {
+		return fmt.Errorf("Invalid version %v of %v: %v", v.Version, v.ID, err)
+	}
+	bz, err := mp.Marshal(storedDocument{Doc: stored})
+	if err != nil {
+		return err
+	}
+	tx.Put(historySide, historyKey(v.ID, v.Version), bz)
+	return nil
+}
@@ -0,0 +1,380 @@
+package mcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Patch formats accepted by Index.Patch, named by their media types
+const (
+	// MergePatchType is an RFC 7386 JSON merge patch
+	MergePatchType = "application/merge-patch+json"
+	// JSONPatchType is an RFC 6902 JSON Patch
+	JSONPatchType = "application/json-patch+json"
+)
+
+// Patch applies a patch to the JSON body of a document, writing the result as a new version of the document
+func (i *Index) Patch(id string, patchType string, patch []byte) (*Document, error) {
+	updated, err := i.update(func(tx *storeTx) (*DocSet, error) {
+		d, ok := tx.Get(id)
+		if !ok || d.Deleted {
+			return nil, fmt.Errorf("Document not found for id %v", id)
+		}
+		if d.IsManifest() {
+			return nil, fmt.Errorf("Invalid patch for %v: manifests cannot be patched", id)
+		}
+		d, err := i.decodeBody(d)
+		if err != nil {
+			return nil, err
+		}
+		body, err := applyPatch(d.Body, patchType, patch)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid patch for %v: %v", id, err)
+		}
+		d.Body = body
+		return NewDocSet(d), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	doc := updated.Docs[id]
+	return &doc, nil
+}
+
+// applyPatch returns the result of applying a patch of the given type to a JSON document
+func applyPatch(body []byte, patchType string, patch []byte) ([]byte, error) {
+	doc, err := decodeJSON(body)
+	if err != nil {
+		return nil, fmt.Errorf("document body is not JSON")
+	}
+	p, err := decodeJSON(patch)
+	if err != nil {
+		return nil, fmt.Errorf("patch is not JSON")
+	}
+
+	switch patchType {
+	case MergePatchType:
+		doc = mergePatch(doc, p)
+	case JSONPatchType:
+		ops, ok := p.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("JSON Patch must be an array of operations")
+		}
+		for n, op := range ops {
+			if doc, err = applyOperation(doc, op); err != nil {
+				return nil, fmt.Errorf("operation %v: %v", n, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown patch type %v", patchType)
+	}
+
+	return encodeJSON(doc)
+}
+
+// encodeJSON encodes a JSON value without escaping HTML characters, so strings the patch did not touch keep their form
+func encodeJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// decodeJSON decodes a single JSON value, keeping numbers as json.Number so they are not rounded
+func decodeJSON(bz []byte) (v interface{}, err error) {
+	dec := json.NewDecoder(bytes.NewReader(bz))
+	dec.UseNumber()
+	if err = dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+// mergePatch applies an RFC 7386 merge patch: objects are merged recursively, nulls remove members, and anything else replaces the target
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// applyOperation applies a single RFC 6902 operation to a document, returning the new document
+func applyOperation(doc interface{}, op interface{}) (interface{}, error) {
+	o, ok := op.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("operation must be an object")
+	}
+	name, _ := o["op"].(string)
+	path, ok := o["path"].(string)
+	if !ok {
+		return nil, fmt.Errorf("missing path")
+	}
+	value, hasValue := o["value"]
+	from, hasFrom := o["from"].(string)
+
+	switch name {
+	case "add", "replace", "test":
+		if !hasValue {
+			return nil, fmt.Errorf("%v requires a value", name)
+		}
+	case "move", "copy":
+		if !hasFrom {
+			return nil, fmt.Errorf("%v requires from", name)
+		}
+	}
+
+	switch name {
+	case "add":
+		return addValue(doc, path, deepCopy(value))
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "replace":
+		doc, _, err := removeValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, deepCopy(value))
+	case "move":
+		if from != path && strings.HasPrefix(path, from+"/") {
+			return nil, fmt.Errorf("cannot move %v into itself", from)
+		}
+		doc, moved, err := removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, moved)
+	case "copy":
+		copied, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, deepCopy(copied))
+	case "test":
+		actual, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(actual, value) {
+			return nil, fmt.Errorf("test failed at %v", path)
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %v", name)
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into unescaped reference tokens
+func parsePointer(path string) ([]string, error) {
+	if path == "" {
+		return []string{}, nil
+	}
+	if path[0] != '/' {
+		return nil, fmt.Errorf("path %v must start with /", path)
+	}
+	tokens := strings.Split(path[1:], "/")
+	for n, t := range tokens {
+		tokens[n] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func getValue(doc interface{}, path string) (interface{}, error) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf("path %v not found", path)
+			}
+			doc = v
+		case []interface{}:
+			n, err := arrayIndex(t, len(c)-1)
+			if err != nil {
+				return nil, fmt.Errorf("path %v: %v", path, err)
+			}
+			doc = c[n]
+		default:
+			return nil, fmt.Errorf("path %v not found", path)
+		}
+	}
+	return doc, nil
+}
+
+// addValue adds a value at `path`, replacing an object member or inserting into an array
+func addValue(doc interface{}, path string, value interface{}) (interface{}, error) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	parentPath := path[:strings.LastIndex(path, "/")]
+	parent, err := getValue(doc, parentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch c := parent.(type) {
+	case map[string]interface{}:
+		c[last] = value
+		return doc, nil
+	case []interface{}:
+		n := len(c)
+		if last != "-" {
+			if n, err = arrayIndex(last, len(c)); err != nil {
+				return nil, fmt.Errorf("path %v: %v", path, err)
+			}
+		}
+		c = append(c, nil)
+		copy(c[n+1:], c[n:])
+		c[n] = value
+		return setValue(doc, parentPath, c)
+	}
+	return nil, fmt.Errorf("path %v not found", path)
+}
+
+// removeValue removes the value at `path`, returning the new document and the removed value
+func removeValue(doc interface{}, path string) (interface{}, interface{}, error) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+	parentPath := path[:strings.LastIndex(path, "/")]
+	parent, err := getValue(doc, parentPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch c := parent.(type) {
+	case map[string]interface{}:
+		removed, ok := c[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("path %v not found", path)
+		}
+		delete(c, last)
+		return doc, removed, nil
+	case []interface{}:
+		n, err := arrayIndex(last, len(c)-1)
+		if err != nil {
+			return nil, nil, fmt.Errorf("path %v: %v", path, err)
+		}
+		removed := c[n]
+		c = append(c[:n:n], c[n+1:]...)
+		doc, err = setValue(doc, parentPath, c)
+		return doc, removed, err
+	}
+	return nil, nil, fmt.Errorf("path %v not found", path)
+}
+
+// setValue replaces the value at `path`, which must exist or be the document itself
+func setValue(doc interface{}, path string, value interface{}) (interface{}, error) {
+	if path == "" {
+		return value, nil
+	}
+	doc, _, err := removeValue(doc, path)
+	if err != nil {
+		return nil, err
+	}
+	return addValue(doc, path, value)
+}
+
+// arrayIndex parses an array index token, which must be between 0 and `max`
+func arrayIndex(token string, max int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %v", token)
+	}
+	n, err := strconv.Atoi(token)
+	if err != nil || n < 0 || n > max {
+		return 0, fmt.Errorf("array index %v out of range", token)
+	}
+	return n, nil
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(c))
+		for k, v := range c {
+			copied[k] = deepCopy(v)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(c))
+		for n, v := range c {
+			copied[n] = deepCopy(v)
+		}
+		return copied
+	}
+	return v
+}
+
+// jsonEqual compares decoded JSON values, treating numbers as equal if they have the same value
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			if w, ok := y[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for n := range x {
+			if !jsonEqual(x[n], y[n]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if x == y {
+			return true
+		}
+		xf, xErr := x.Float64()
+		yf, yErr := y.Float64()
+		return xErr == nil && yErr == nil && xf == yf
+	}
+	return a == b
+}
@@ -0,0 +1,146 @@
+package mcache
+
+import "time"
+
+// Purge permanently removes documents and their history from the index's store and cache, returning the IDs of those that existed.
+// Unlike SoftDelete, no tombstone is kept, so clients that already synced a purged document will not be told it is gone.
+func (i *Index) Purge(ids IDSet) (purged IDSet, err error) {
+	purged = IDSet{}
+	err = i.use(func() error {
+		return i.docs.UpdateMap(func(tx *storeTx) error {
+			changes := []membershipChange{}
+			for id := range ids {
+				prev, exists := tx.Get(id)
+				if !exists {
+					continue
+				}
+				if change, err := diffMembership(prev, Document{ID: id}, i.cipher); err != nil {
+					return err
+				} else if change != nil {
+					changes = append(changes, *change)
+				}
+				tx.Delete(id)
+				tx.Remove(trashSide, id)
+				if err := removeHistory(tx, id); err != nil {
+					return err
+				}
+				purged[id] = SetEntry{}
+			}
+			tx.OnCommit(func() {
+				i.forget(purged, changes)
+			})
+			return nil
+		})
+	})
+	return
+}
+
+// CompactTombstones purges tombstones older than `retention`, keeping any that a client might not have seen yet:
+// a tombstone is only purged once every manifest containing it has been queried, and every named client's cursor for those manifests is at or after its deletion.
+// Cursors of clients that have not queried a manifest within `retention` are forgotten first, so clients that stopped syncing do not keep tombstones forever.
+func (i *Index) CompactTombstones(retention time.Duration) (compacted int, err error) {
+	cutoff := time.Now().Add(-retention).Unix()
+	expired := i.expireCursors(cutoff)
+	cursors, pending := i.takeCursors()
+	err = i.use(func() error {
+		return i.docs.UpdateMap(func(tx *storeTx) error {
+			for _, key := range expired {
+				tx.Remove(cursorsSide, key)
+			}
+			putCursors(tx, pending)
+			purged := IDSet{}
+			for id, d := range tx.m {
+				if !d.Deleted || d.UpdatedAt > cutoff || !cursorsPassed(cursors, i.membership.containing(id), d.UpdatedAt) {
+					continue
+				}
+				tx.Delete(id)
+				tx.Remove(trashSide, id)
+				if err := removeHistory(tx, id); err != nil {
+					return err
+				}
+				purged[id] = SetEntry{}
+			}
+			compacted = len(purged)
+			tx.OnCommit(func() {
+				i.forget(purged, nil)
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		i.restorePendingCursors(pending)
+	}
+	return
+}
+
+// forget removes purged documents from the index's caches and applies any changes to its membership index
+func (i *Index) forget(purged IDSet, changes []membershipChange) {
+	for id := range purged {
+		i.cache.Remove(id)
+		i.manifests.remove(id)
+	}
+	for _, c := range changes {
+		i.membership.update(c.manifestID, c.before, c.after)
+	}
+}
+
+// cursorsPassed returns true if every given manifest has been queried, and all of their named clients' cursors are at or after `updatedAt`
+func cursorsPassed(cursors clientCursors, manifestIDs IDSet, updatedAt Timestamp) bool {
+	for id := range manifestIDs {
+		if _, queried := cursors[id][""]; !queried {
+			return false
+		}
+		for clientID, cursor := range cursors[id] {
+			if clientID != "" && cursor.after < updatedAt {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compactIndexes periodically compacts the tombstones of open indexes, discards versions that can no longer be restored and removes unreferenced blobs
+func (m *IndexManager) compactIndexes() {
+	ticker := time.NewTicker(m.config.CompactionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			open := m.WithRLock(func() interface{} {
+				open := make([]*Index, 0, len(m.open))
+				for _, i := range m.open {
+					open = append(open, i)
+				}
+				return open
+			}).([]*Index)
+
+			for _, i := range open {
+				if m.config.TombstoneRetention > 0 {
+					compacted, err := i.CompactTombstones(m.config.TombstoneRetention)
+					if err != nil {
+						m.config.logf("Error compacting index %v: %v\n", i.ID, err)
+					} else if compacted > 0 {
+						m.config.logf("Compacted %v tombstones in index %v\n", compacted, i.ID)
+					}
+				}
+				if m.config.RestoreRetention > 0 {
+					expired, err := i.ExpireTrash(m.config.RestoreRetention)
+					if err != nil {
+						m.config.logf("Error expiring deleted documents in index %v: %v\n", i.ID, err)
+					} else if expired > 0 {
+						m.config.logf("Expired %v deleted documents in index %v\n", expired, i.ID)
+					}
+				}
+				collected, err := i.CollectBlobs(blobGracePeriod)
+				if err != nil {
+					m.config.logf("Error collecting blobs in index %v: %v\n", i.ID, err)
+				} else if collected > 0 {
+					m.config.logf("Removed %v unreferenced blobs in index %v\n", collected, i.ID)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package mcache
+
+import (
+	"fmt"
+	"time"
+
+	mp "github.com/vmihailenco/msgpack"
+)
+
+// trashSide is the side bucket holding the last live version of each deleted document, keyed by document ID
+const trashSide = "trash"
+
+// keepForRestore saves the last live version of a document that `d` is deleting, and discards it once the document is written again
+func (i *Index) keepForRestore(tx *storeTx, prev Document, exists bool, d Document) error {
+	if !exists {
+		return nil
+	}
+	if d.Deleted && !prev.Deleted && i.config.RestoreRetention > 0 {
+		bz, err := mp.Marshal(storedDocument{Doc: prev})
+		if err != nil {
+			return err
+		}
+		tx.Put(trashSide, d.ID, bz)
+	} else if !d.Deleted && prev.Deleted {
+		tx.Remove(trashSide, d.ID)
+	}
+	return nil
+}
+
+// Restore undoes the deletion of documents deleted within the restore retention window, writing their last live versions as new updates
+func (i *Index) Restore(ids IDSet) (*DocSet, error) {
+	cutoff := time.Now().Add(-i.config.RestoreRetention).Unix()
+	return i.update(func(tx *storeTx) (*DocSet, error) {
+		restored := NewDocSet()
+		for id := range ids {
+			tombstone, exists := tx.Get(id)
+			if !exists || !tombstone.Deleted {
+				return nil, fmt.Errorf("Invalid restore: document %v is not deleted", id)
+			}
+			bz, err := tx.Load(trashSide, id)
+			if err != nil {
+				return nil, err
+			}
+			if bz == nil || tombstone.UpdatedAt < cutoff {
+				return nil, fmt.Errorf("Invalid restore: document %v has no restorable version", id)
+			}
+			stored := storedDocument{}
+			if err = mp.Unmarshal(bz, &stored); err != nil {
+				return nil, fmt.Errorf("Unable to decode deleted document %v: %v", id, err)
+			}
+			// the document may have been deleted because it expired, so it is given a new expiry when it is written
+			stored.Doc.ExpiresAt = 0
+			exported, err := i.export(stored.Doc)
+			if err != nil {
+				return nil, err
+			}
+			restored.Add(exported)
+		}
+		return restored, nil
+	})
+}
+
+// ExpireTrash discards the saved versions of documents deleted longer than `retention` ago, so they can no longer be restored
+func (i *Index) ExpireTrash(retention time.Duration) (expired int, err error) {
+	cutoff := time.Now().Add(-retention).Unix()
+	err = i.use(func() error {
+		return i.docs.UpdateMap(func(tx *storeTx) error {
+			return tx.ForEach(trashSide, "", func(id string, _ []byte) error {
+				if d, ok := tx.m[id]; ok && d.Deleted && d.UpdatedAt >= cutoff {
+					return nil
+				}
+				tx.Remove(trashSide, id)
+				expired++
+				return nil
+			})
+		})
+	})
+	return
+}
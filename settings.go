@@ -0,0 +1,80 @@
+package mcache
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// settingsSide is the side bucket holding an index's settings, under settingsKey
+const settingsSide = "settings"
+const settingsKey = "index"
+
+// IndexSettings holds options that are set per index and stored in the index's file
+type IndexSettings struct {
+	// HistoryVersions is the number of previous versions kept for each document
+	HistoryVersions int `json:"historyVersions"`
+	// HistorySeconds keeps any previous version that was replaced within this many seconds, in addition to the last HistoryVersions
+	HistorySeconds int64 `json:"historySeconds"`
+	// DefaultTTLSeconds sets the expiry of documents written without one to this many seconds after they are written (0 never expires them)
+	DefaultTTLSeconds int64 `json:"defaultTTLSeconds"`
+	// CompressionThreshold compresses the bodies of documents (but not manifests) of at least this many bytes when they are written (0 disables compression)
+	CompressionThreshold int `json:"compressionThreshold"`
+}
+
+// historyEnabled returns true if previous versions of documents are kept
+func (s IndexSettings) historyEnabled() bool {
+	return s.HistoryVersions > 0 || s.HistorySeconds > 0
+}
+
+func (s IndexSettings) validate() error {
+	if s.HistoryVersions < 0 || s.HistorySeconds < 0 {
+		return fmt.Errorf("Invalid settings: history retention cannot be negative")
+	}
+	if s.DefaultTTLSeconds < 0 {
+		return fmt.Errorf("Invalid settings: default TTL cannot be negative")
+	}
+	if s.CompressionThreshold < 0 {
+		return fmt.Errorf("Invalid settings: compression threshold cannot be negative")
+	}
+	return nil
+}
+
+// loadSettings reads the settings stored in an index's file, returning the defaults if none are stored
+func loadSettings(docs *docStore) (settings IndexSettings, err error) {
+	bz, err := docs.Load(settingsSide, settingsKey)
+	if err != nil || bz == nil {
+		return
+	}
+	err = json.Unmarshal(bz, &settings)
+	return
+}
+
+// Settings returns the index's settings
+func (i *Index) Settings() (settings IndexSettings, err error) {
+	err = i.view(func(map[string]Document) error {
+		settings = i.settings
+		return nil
+	})
+	return
+}
+
+// SetSettings replaces the index's settings. Changes to history retention and compression apply to each document when it is next written
+// (see Index.Recompress to apply compression to stored documents immediately).
+func (i *Index) SetSettings(settings IndexSettings) error {
+	if err := settings.validate(); err != nil {
+		return err
+	}
+	bz, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return i.use(func() error {
+		return i.docs.UpdateMap(func(tx *storeTx) error {
+			tx.Put(settingsSide, settingsKey, bz)
+			tx.OnCommit(func() {
+				i.settings = settings
+			})
+			return nil
+		})
+	})
+}
@@ -0,0 +1,357 @@
+package mcache
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// snapshotFormat is the version of the snapshot archive format, which is refused by versions of MCache that do not know it
+const snapshotFormat = 1
+
+// Snapshot archive entries, in the order they are written
+const (
+	// snapshotInfoName is a JSON-encoded SnapshotInfo
+	snapshotInfoName = "snapshot.json"
+	// snapshotIndexName is a copy of the index's file
+	snapshotIndexName = "index.db"
+	// snapshotBlobPrefix is followed by the hash of each blob referenced by the index
+	snapshotBlobPrefix = "blobs/"
+)
+
+// SnapshotInfo describes a snapshot archive
+type SnapshotInfo struct {
+	Format    int       `json:"format"`
+	IndexID   string    `json:"indexID"`
+	CreatedAt Timestamp `json:"createdAt"`
+	Blobs     []string  `json:"blobs"`
+}
+
+// Snapshot writes a consistent tar archive of the index to `w` while the index continues to serve reads and writes.
+// The archive holds a copy of the index's file as of a single transaction, along with every blob that copy refers to.
+// The copy is first written to a temporary file next to the index's file, so the transaction is not held open while `w` is written to.
+// Bodies in encrypted indexes stay encrypted, so the archive can only be restored with the same master key.
+func (i *Index) Snapshot(w io.Writer) (info SnapshotInfo, err error) {
+	err = i.use(func() error {
+		var btx *bolt.Tx
+		blobs := map[string]*os.File{}
+		defer func() {
+			for _, f := range blobs {
+				f.Close()
+			}
+		}()
+
+		// the blobs are opened while the store is locked, so they cannot be collected before they are copied
+		var openErr error
+		i.docs.DoWithMap(func(m map[string]Document) {
+			refs, err := i.blobRefs(m)
+			if err != nil {
+				openErr = err
+				return
+			}
+			for hash := range refs {
+				f, err := os.Open(i.blobPath(hash))
+				if err != nil {
+					openErr = fmt.Errorf("Unable to open blob %v: %v", hash, err)
+					return
+				}
+				blobs[hash] = f
+			}
+			btx, openErr = i.docs.beginRead()
+		})
+		if openErr != nil {
+			return openErr
+		}
+		db, err := copyToTempFile(btx, filepath.Dir(i.path))
+		btx.Rollback()
+		if err != nil {
+			return fmt.Errorf("Unable to copy index %v: %v", i.ID, err)
+		}
+		defer func() {
+			db.Close()
+			os.Remove(db.Name())
+		}()
+		dbStat, err := db.Stat()
+		if err != nil {
+			return err
+		}
+
+		info = SnapshotInfo{Format: snapshotFormat, IndexID: i.ID, CreatedAt: time.Now().Unix(), Blobs: []string{}}
+		for hash := range blobs {
+			info.Blobs = append(info.Blobs, hash)
+		}
+		sort.Strings(info.Blobs)
+		infoBz, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+
+		tw := tar.NewWriter(w)
+		modTime := time.Unix(info.CreatedAt, 0)
+		if err := writeTarEntry(tw, snapshotInfoName, int64(len(infoBz)), modTime, func(w io.Writer) error {
+			_, err := w.Write(infoBz)
+			return err
+		}); err != nil {
+			return err
+		}
+		if err := writeTarEntry(tw, snapshotIndexName, dbStat.Size(), modTime, func(w io.Writer) error {
+			_, err := io.Copy(w, db)
+			return err
+		}); err != nil {
+			return err
+		}
+		for _, hash := range info.Blobs {
+			f := blobs[hash]
+			stat, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			if err := writeTarEntry(tw, snapshotBlobPrefix+hash, stat.Size(), stat.ModTime(), func(w io.Writer) error {
+				_, err := io.Copy(w, f)
+				return err
+			}); err != nil {
+				return err
+			}
+		}
+		return tw.Close()
+	})
+	return
+}
+
+// copyToTempFile writes the database as of a read transaction to a new temporary file in `dir`, returning the file open at its start
+func copyToTempFile(btx *bolt.Tx, dir string) (*os.File, error) {
+	f, err := ioutil.TempFile(dir, "snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = btx.WriteTo(f); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// SnapshotAll writes a snapshot of every index to a new file in `dir`, returning the paths of the files
+func (m *IndexManager) SnapshotAll(dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	indexes := m.WithRLock(func() interface{} {
+		indexes := make([]*Index, 0, len(m.Indexes))
+		for _, i := range m.Indexes {
+			indexes = append(indexes, i)
+		}
+		return indexes
+	}).([]*Index)
+
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	paths := []string{}
+	for _, i := range indexes {
+		path := filepath.Join(dir, i.ID+"-"+stamp+".tar")
+		if err := snapshotToFile(i, path); err != nil {
+			return paths, fmt.Errorf("Failed to snapshot index %v: %v", i.ID, err)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func snapshotToFile(i *Index, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = i.Snapshot(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, modTime time.Time, write func(w io.Writer) error) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size, ModTime: modTime, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	return write(tw)
+}
+
+// Restore loads a snapshot archive as the index with the given ID, which may differ from the ID of the index it was taken from.
+// An existing index is only replaced if `replace` is true; it is closed once its in-progress operations finish,
+// and requests to it fail until the restored index takes its place. If it cannot be closed, it is kept and the restore fails.
+func (m *IndexManager) Restore(id string, r io.Reader, replace bool) (*SnapshotInfo, error) {
+	if m.GetIndex(id) != nil && !replace {
+		return nil, fmt.Errorf("Invalid restore: index %v already exists", id)
+	}
+	if err := os.MkdirAll(m.path, 0700); err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(r)
+	info := SnapshotInfo{}
+	if err := readTarEntry(tr, snapshotInfoName, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&info)
+	}); err != nil {
+		return nil, err
+	}
+	if info.Format != snapshotFormat {
+		return nil, fmt.Errorf("Invalid snapshot: unsupported format %v", info.Format)
+	}
+	if info.IndexID == "" {
+		return nil, fmt.Errorf("Invalid snapshot: missing index ID")
+	}
+
+	tmp, err := ioutil.TempFile(m.path, "restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	err = readTarEntry(tr, snapshotIndexName, func(r io.Reader) error {
+		_, err := io.Copy(tmp, r)
+		return err
+	})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// blobs are content-addressed, so they can be written alongside the existing index's blobs before it is replaced
+	path := filepath.Join(m.path, indexFilenamePrefix+id+indexFilenameSuffix)
+	staging := NewIndex(id, path, m.newCache, m.config)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Invalid snapshot: %v", err)
+		}
+		hash := strings.TrimPrefix(header.Name, snapshotBlobPrefix)
+		if !strings.HasPrefix(header.Name, snapshotBlobPrefix) || !isBlobHash(hash) {
+			return nil, fmt.Errorf("Invalid snapshot: unexpected entry %v", header.Name)
+		}
+		ref, err := staging.writeBlob(tr)
+		if err != nil {
+			return nil, err
+		}
+		if ref.Hash != hash {
+			return nil, fmt.Errorf("Invalid snapshot: blob %v does not match its checksum", hash)
+		}
+	}
+
+	if err = prepareRestoredStore(tmp.Name(), info.IndexID, id, m.config); err != nil {
+		return nil, err
+	}
+
+	var existing *Index
+	m.DoWithRWLock(func() {
+		existing = m.Indexes[id]
+		if existing == nil || replace {
+			delete(m.Indexes, id)
+			delete(m.open, id)
+		}
+	})
+	if existing != nil {
+		if !replace {
+			return nil, fmt.Errorf("Invalid restore: index %v already exists", id)
+		}
+		if err = existing.Close(); err != nil {
+			// the existing index's file is left in place, so it is registered again to be reopened on its next use
+			m.register(id)
+			return nil, fmt.Errorf("Unable to close index %v before restoring it: %v", id, err)
+		}
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	m.register(id)
+	return &info, nil
+}
+
+func readTarEntry(tr *tar.Reader, name string, read func(r io.Reader) error) error {
+	header, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("Invalid snapshot: %v", err)
+	}
+	if header.Name != name {
+		return fmt.Errorf("Invalid snapshot: expected %v, found %v", name, header.Name)
+	}
+	if err = read(tr); err != nil {
+		return fmt.Errorf("Invalid snapshot: unable to read %v: %v", name, err)
+	}
+	return nil
+}
+
+// prepareRestoredStore renames the buckets of a restored index file from `from` to `to`, then checks that it can be opened
+func prepareRestoredStore(path, from, to string, config Config) error {
+	if from != to {
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: storeOpenTimeout})
+		if err != nil {
+			return fmt.Errorf("Invalid snapshot: %v", err)
+		}
+		err = db.Update(func(btx *bolt.Tx) error {
+			names := []string{}
+			if err := btx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				if string(name) == from || strings.HasPrefix(string(name), from+"/") {
+					names = append(names, string(name))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, name := range names {
+				if err := renameBucket(btx, name, to+strings.TrimPrefix(name, from)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to rename restored index: %v", err)
+		}
+	}
+
+	docs, err := openDocStore(path, to)
+	if err != nil {
+		return fmt.Errorf("Invalid snapshot: %v", err)
+	}
+	defer docs.Close()
+	if _, err = loadDataKey(docs, config); err != nil {
+		return fmt.Errorf("Unable to restore index %v: %v", to, err)
+	}
+	return nil
+}
+
+func renameBucket(btx *bolt.Tx, from, to string) error {
+	src := btx.Bucket([]byte(from))
+	dst, err := btx.CreateBucket([]byte(to))
+	if err != nil {
+		return err
+	}
+	if err = src.ForEach(func(k, v []byte) error {
+		return dst.Put(k, v)
+	}); err != nil {
+		return err
+	}
+	return btx.DeleteBucket([]byte(from))
+}
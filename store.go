@@ -0,0 +1,347 @@
+package mcache
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	mp "github.com/vmihailenco/msgpack"
+	bolt "go.etcd.io/bbolt"
+)
+
+const storeOpenTimeout = time.Second
+
+// docStore is a map of document IDs to Documents, protected by a RWMutex and backed by a bbolt database
+type docStore struct {
+	mut  *sync.RWMutex
+	db   *bolt.DB
+	name string
+	m    map[string]Document
+	// bodies maps the ID of each document whose body is in the body area to the body's key
+	bodies map[string]string
+}
+
+// storedDocument is the on-disk encoding of a Document (compatible with Duramap's encoding).
+// Documents in the map are stored without their body if BodyKey refers to it in the body area.
+type storedDocument struct {
+	Doc     Document `msgpack:"."`
+	BodyKey string   `msgpack:"bodyKey,omitempty"`
+}
+
+// openDocStore opens the bbolt database at `path` and loads the documents stored in the bucket `name`
+func openDocStore(path, name string) (*docStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: storeOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &docStore{&sync.RWMutex{}, db, name, map[string]Document{}, map[string]string{}}
+	if err = s.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *docStore) load() error {
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(s.name))
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		bodies, err := loadBodies(tx.Bucket(s.sideBucket(bodiesSide)))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(s.name)).ForEach(func(k, bz []byte) error {
+			if len(bz) == 0 {
+				return nil
+			}
+			stored := storedDocument{}
+			if err := mp.Unmarshal(bz, &stored); err != nil {
+				return fmt.Errorf("Unable to decode document %v: %v", string(k), err)
+			}
+			if stored.BodyKey != "" {
+				body, ok := bodies[stored.BodyKey]
+				if !ok {
+					return fmt.Errorf("Missing body %v of document %v", stored.BodyKey, string(k))
+				}
+				stored.Doc.Body = body
+				s.bodies[string(k)] = stored.BodyKey
+			}
+			s.m[string(k)] = stored.Doc
+			return nil
+		})
+	})
+}
+
+// sideBucket returns the name of a bucket that holds extra data about the store's documents
+func (s *docStore) sideBucket(side string) []byte {
+	return []byte(s.name + "/" + side)
+}
+
+// Load returns a value from a side bucket while holding a read lock, or nil if it is not found
+func (s *docStore) Load(side, key string) (bz []byte, err error) {
+	defer s.mut.RUnlock()
+	s.mut.RLock()
+	return s.loadSide(side, key)
+}
+
+// ForEach calls `f` in key order with each key and value in a side bucket whose key starts with `prefix`, while holding a read lock
+func (s *docStore) ForEach(side, prefix string, f func(k string, bz []byte) error) error {
+	defer s.mut.RUnlock()
+	s.mut.RLock()
+	return s.forEachSide(side, prefix, f)
+}
+
+// closedErr returns an error if the store has been closed. It must be called while holding the store's lock.
+func (s *docStore) closedErr() error {
+	if s.db == nil {
+		return fmt.Errorf("Store %v is closed", s.name)
+	}
+	return nil
+}
+
+func (s *docStore) loadSide(side, key string) (bz []byte, err error) {
+	if err = s.closedErr(); err != nil {
+		return
+	}
+	err = s.db.View(func(btx *bolt.Tx) error {
+		b := btx.Bucket(s.sideBucket(side))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(key)); v != nil {
+			bz = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return
+}
+
+func (s *docStore) forEachSide(side, prefix string, f func(k string, bz []byte) error) error {
+	if err := s.closedErr(); err != nil {
+		return err
+	}
+	return s.db.View(func(btx *bolt.Tx) error {
+		return s.forEachSideIn(btx, side, prefix, f)
+	})
+}
+
+// forEachSideIn is like forEachSide, but reads from a transaction started with beginRead
+func (s *docStore) forEachSideIn(btx *bolt.Tx, side, prefix string, f func(k string, bz []byte) error) error {
+	b := btx.Bucket(s.sideBucket(side))
+	if b == nil {
+		return nil
+	}
+	c := b.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+		if err := f(string(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// beginRead starts a read-only bolt transaction, which sees a consistent copy of the database until it is rolled back
+func (s *docStore) beginRead() (*bolt.Tx, error) {
+	if err := s.closedErr(); err != nil {
+		return nil, err
+	}
+	return s.db.Begin(false)
+}
+
+// DoWithMap calls `f` with the internal map while holding a read lock
+func (s *docStore) DoWithMap(f func(m map[string]Document)) {
+	defer s.mut.RUnlock()
+	s.mut.RLock()
+	f(s.m)
+}
+
+// UpdateMap calls `f` with a transaction while holding a write lock, then persists and applies the transaction's writes.
+// Functions registered with `tx.OnCommit` are called after the writes are applied, before the lock is released.
+func (s *docStore) UpdateMap(f func(tx *storeTx) error) error {
+	defer s.mut.Unlock()
+	s.mut.Lock()
+
+	if err := s.closedErr(); err != nil {
+		return err
+	}
+
+	tx := &storeTx{s: s, m: s.m, writes: map[string]Document{}, deletes: IDSet{}, sides: map[string]map[string][]byte{}, onCommit: []func(){}}
+	if err := f(tx); err != nil {
+		return err
+	}
+
+	if len(tx.writes) == 0 && len(tx.deletes) == 0 && len(tx.sides) == 0 {
+		for _, f := range tx.onCommit {
+			f()
+		}
+		return nil
+	}
+
+	refs := newBodyRefs()
+	bzWrites := map[string][]byte{}
+	for k, v := range tx.writes {
+		stored := storedDocument{Doc: v}
+		if len(v.Body) > 0 {
+			stored.BodyKey = refs.add(v.Body)
+			stored.Doc.Body = nil
+		}
+		refs.remove(s.bodies[k])
+		bz, err := mp.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		bzWrites[k] = bz
+		refs.keys[k] = stored.BodyKey
+	}
+	for k := range tx.deletes {
+		refs.remove(s.bodies[k])
+	}
+
+	err := s.db.Update(func(btx *bolt.Tx) error {
+		b, err := btx.CreateBucketIfNotExists([]byte(s.name))
+		if err != nil {
+			return err
+		}
+		for k, bz := range bzWrites {
+			if err := b.Put([]byte(k), bz); err != nil {
+				return err
+			}
+		}
+		for k := range tx.deletes {
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		if err := refs.commit(btx, s); err != nil {
+			return err
+		}
+		for side, values := range tx.sides {
+			sb, err := btx.CreateBucketIfNotExists(s.sideBucket(side))
+			if err != nil {
+				return err
+			}
+			for k, bz := range values {
+				if bz == nil {
+					err = sb.Delete([]byte(k))
+				} else {
+					err = sb.Put([]byte(k), bz)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for k, v := range tx.writes {
+		s.m[k] = v
+		if key := refs.keys[k]; key != "" {
+			s.bodies[k] = key
+		} else {
+			delete(s.bodies, k)
+		}
+	}
+	for k := range tx.deletes {
+		delete(s.m, k)
+		delete(s.bodies, k)
+	}
+	for _, f := range tx.onCommit {
+		f()
+	}
+
+	return nil
+}
+
+// Close waits for any readers or writers to finish, then closes the database
+func (s *docStore) Close() error {
+	defer s.mut.Unlock()
+	s.mut.Lock()
+
+	if s.db == nil {
+		return nil
+	}
+
+	err := s.db.Close()
+	s.db = nil
+	s.m = map[string]Document{}
+	s.bodies = map[string]string{}
+	return err
+}
+
+// storeTx is a transaction that operates on a docStore
+type storeTx struct {
+	s        *docStore
+	m        map[string]Document
+	writes   map[string]Document
+	deletes  IDSet
+	sides    map[string]map[string][]byte
+	onCommit []func()
+}
+
+// Get returns the latest version of a document either written in the transaction or stored in the map
+func (tx *storeTx) Get(k string) (Document, bool) {
+	if _, deleted := tx.deletes[k]; deleted {
+		return Document{}, false
+	}
+	if d, ok := tx.writes[k]; ok {
+		return d, true
+	}
+	d, ok := tx.m[k]
+	return d, ok
+}
+
+// Set writes a document in the transaction
+func (tx *storeTx) Set(k string, d Document) {
+	delete(tx.deletes, k)
+	tx.writes[k] = d
+}
+
+// Delete removes a document in the transaction
+func (tx *storeTx) Delete(k string) {
+	delete(tx.writes, k)
+	tx.deletes[k] = SetEntry{}
+}
+
+// Load returns the latest value in a side bucket either written in the transaction or stored on disk, or nil if it is not found
+func (tx *storeTx) Load(side, key string) ([]byte, error) {
+	if bz, ok := tx.sides[side][key]; ok {
+		return bz, nil
+	}
+	return tx.s.loadSide(side, key)
+}
+
+// ForEach calls `f` in key order with each key and value stored on disk in a side bucket whose key starts with `prefix`, ignoring the transaction's writes
+func (tx *storeTx) ForEach(side, prefix string, f func(k string, bz []byte) error) error {
+	return tx.s.forEachSide(side, prefix, f)
+}
+
+// Put writes a value to a side bucket in the transaction
+func (tx *storeTx) Put(side, key string, bz []byte) {
+	if tx.sides[side] == nil {
+		tx.sides[side] = map[string][]byte{}
+	}
+	tx.sides[side][key] = bz
+}
+
+// Remove deletes a value from a side bucket in the transaction
+func (tx *storeTx) Remove(side, key string) {
+	tx.Put(side, key, nil)
+}
+
+// OnCommit registers `f` to be called once the transaction has been committed, while the store is still locked
+func (tx *storeTx) OnCommit(f func()) {
+	tx.onCommit = append(tx.onCommit, f)
+}
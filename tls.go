@@ -0,0 +1,138 @@
+package mcache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is the minimum time between checks for a changed certificate on disk
+const certReloadInterval = 10 * time.Second
+
+// TLSEnabled returns true if the configuration includes a certificate and key
+func (c Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// validateTLS rejects partial TLS configurations, which would otherwise silently serve plain HTTP
+func validateTLS(config Config) error {
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return fmt.Errorf("Invalid TLS configuration: a certificate file and a key file must be set together")
+	}
+	if config.TLSClientCAFile != "" && !config.TLSEnabled() {
+		return fmt.Errorf("Invalid TLS configuration: a client CA file requires a certificate file and a key file")
+	}
+	return nil
+}
+
+// NewTLSConfig returns a TLS configuration for serving MCache over HTTPS.
+// The certificate is reloaded when its files change on disk, and client certificates are required if a client CA is configured.
+func NewTLSConfig(config Config) (*tls.Config, error) {
+	if !config.TLSEnabled() {
+		return nil, fmt.Errorf("TLS requires both a certificate file and a key file")
+	}
+
+	reloader, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(config.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read client CA file %v: %v", config.TLSClientCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in client CA file %v", config.TLSClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// certReloader holds a certificate and reloads it when the certificate or key file is modified
+type certReloader struct {
+	sync.Mutex
+	certFile    string
+	keyFile     string
+	cert        *tls.Certificate
+	modTime     time.Time
+	lastChecked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the latest certificate, checking the files for changes at most every `certReloadInterval`
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if time.Since(r.lastChecked) < certReloadInterval {
+		return r.cert, nil
+	}
+	r.lastChecked = time.Now()
+
+	modTime, err := r.latestModTime()
+	if err != nil || !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+
+	if err := r.unsafeLoad(modTime); err != nil {
+		fmt.Printf("Keeping previous certificate, reload failed: %v\n", err)
+	}
+	return r.cert, nil
+}
+
+func (r *certReloader) reload() error {
+	r.Lock()
+	defer r.Unlock()
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	r.lastChecked = time.Now()
+	return r.unsafeLoad(modTime)
+}
+
+func (r *certReloader) unsafeLoad(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load certificate %v: %v", r.certFile, err)
+	}
+	fmt.Printf("Loaded certificate %v\n", r.certFile)
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	latest := time.Time{}
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, fmt.Errorf("Unable to stat %v: %v", path, err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -1,18 +1,49 @@
 package mcache
 
 import (
+	"bytes"
 	"encoding/json"
 )
 
 // Timestamp is a Unix milliseconds offset
 type Timestamp = int64
 
+// Document kinds
+const (
+	// DocumentKind is an opaque document
+	DocumentKind = "document"
+	// ManifestKind is a document whose body is a JSON-encoded IDSet
+	ManifestKind = "manifest"
+)
+
 // Document is a resource that can be accessed by users
 type Document struct {
 	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
 	UpdatedAt Timestamp `json:"updatedAt"`
+	Version   int64     `json:"version"`
 	Body      []byte    `json:"body"`
 	Deleted   bool      `json:"deleted"`
+	// Hash is the hex-encoded SHA-256 hash of the stored body, which changes whenever the body does
+	Hash string `json:"hash,omitempty"`
+	// Blob refers to a large attachment stored outside the index (see Index.PutBlob)
+	Blob *BlobRef `json:"blob,omitempty"`
+	// Encoding is set on stored documents whose body is compressed, and is never sent to clients
+	Encoding  string    `json:"-" msgpack:",omitempty"`
+	ExpiresAt Timestamp `json:"expiresAt,omitempty"`
+	// ContentType is the media type of the body, used when the document is fetched on its own
+	ContentType string `json:"contentType,omitempty"`
+	// Meta holds tags and other metadata, returned as headers when the document is fetched on its own
+	Meta map[string]string `json:"meta,omitempty"`
+	// Delta replaces Body in query results when the client already holds BaseVersion of the document (see ApplyDelta).
+	// Both are only set by queries, and are ignored on write and never stored.
+	Delta       []byte `json:"delta,omitempty" msgpack:"-"`
+	BaseVersion int64  `json:"baseVersion,omitempty" msgpack:"-"`
+}
+
+// IsManifest returns true if the document is a manifest
+func (d Document) IsManifest() bool {
+	return d.Kind == ManifestKind
 }
 
 // IDSet is an emulated Set (map of strings to empty structs) of document ID
@@ -59,6 +90,20 @@ func (d *DocSet) Merge(docs *DocSet) *DocSet {
 	return d
 }
 
+// ManifestQuery requests the documents in a manifest that were updated after a cursor
+type ManifestQuery struct {
+	ManifestID string    `json:"manifestID"`
+	After      Timestamp `json:"after"`
+	// Known maps the IDs of documents the client holds to their versions, so changed documents can be sent as deltas
+	Known map[string]int64 `json:"known,omitempty"`
+}
+
+// QueryManyResult holds the documents matching several manifest queries, and the cursor to use for each manifest's next query
+type QueryManyResult struct {
+	*DocSet
+	Cursors map[string]Timestamp `json:"cursors"`
+}
+
 // NewIDSet returns an IDSet for a set of IDs
 func NewIDSet(ids ...string) IDSet {
 	idset := IDSet{}
@@ -86,15 +131,32 @@ func (m *Manifest) Encode() (*Document, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Document{ID: m.ID, UpdatedAt: m.UpdatedAt, Body: body}, nil
+	return &Document{ID: m.ID, Kind: ManifestKind, UpdatedAt: m.UpdatedAt, Body: body}, nil
 }
 
-// DecodeManifest returns a Manifest that is stored in a Document
+// DecodeManifest returns a Manifest that is stored in a Document, whose body may be in JSON or compact form
 func DecodeManifest(d Document) (*Manifest, error) {
-	documentIDs := IDSet{}
-	err := json.Unmarshal(d.Body, &documentIDs)
+	documentIDs, err := decodeManifestBody(d.Body)
 	if err != nil {
 		return nil, err
 	}
 	return &Manifest{ID: d.ID, UpdatedAt: d.UpdatedAt, DocumentIDs: documentIDs}, nil
 }
+
+// isLegacyManifestBody returns true if a body is a JSON object whose values are all exactly `{}`, as manifests were written before kinds existed
+func isLegacyManifestBody(body []byte) bool {
+	if len(body) == 0 || body[0] != '{' {
+		return false
+	}
+	values := map[string]json.RawMessage{}
+	if json.Unmarshal(body, &values) != nil {
+		return false
+	}
+	for _, v := range values {
+		compact := &bytes.Buffer{}
+		if json.Compact(compact, v) != nil || compact.String() != "{}" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,196 @@
+package mcache
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// warmBatchSize is the number of documents loaded into the cache each time the store is locked during a warm-up
+const warmBatchSize = 100
+
+// warmQueueSize is the number of indexes that can wait to be warmed up
+const warmQueueSize = 1024
+
+// Warm-up states
+const (
+	WarmupRunning = "running"
+	WarmupDone    = "done"
+	WarmupStopped = "stopped"
+)
+
+// WarmupStatus describes the progress of preloading an index's cache
+type WarmupStatus struct {
+	State      string    `json:"state"`
+	Loaded     int       `json:"loaded"`
+	Total      int       `json:"total"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// Warm preloads the index's cache with all of its manifests and then its most recently updated documents, until the cache is full.
+// It does nothing if the index has already been warmed since it was opened, and stops early if `stop` is closed or the index is closed.
+func (i *Index) Warm(stop <-chan struct{}) error {
+	return i.use(func() error {
+		status := i.startWarmup()
+		if status == nil {
+			return nil
+		}
+
+		ids := i.warmupOrder()
+		status.Total = len(ids)
+		i.setWarmup(*status)
+
+		for start := 0; start < len(ids); start += warmBatchSize {
+			select {
+			case <-stop:
+				status.State = WarmupStopped
+			default:
+			}
+			if i.isClosing() {
+				status.State = WarmupStopped
+			}
+			if status.State == WarmupStopped {
+				break
+			}
+
+			end := start + warmBatchSize
+			if end > len(ids) {
+				end = len(ids)
+			}
+
+			full := false
+			i.docs.DoWithMap(func(m map[string]Document) {
+				for _, id := range ids[start:end] {
+					if i.cache.Full() {
+						full = true
+						return
+					}
+					if d, ok := m[id]; ok {
+						i.cache.Add(d)
+						status.Loaded++
+					}
+				}
+			})
+			i.setWarmup(*status)
+
+			if full {
+				break
+			}
+		}
+
+		if status.State == WarmupRunning {
+			status.State = WarmupDone
+		}
+		status.FinishedAt = time.Now()
+		i.setWarmup(*status)
+		return nil
+	})
+}
+
+// WarmupStatus returns the progress of the index's cache warm-up, or nil if it has not been warmed since it was opened
+func (i *Index) WarmupStatus() *WarmupStatus {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	if i.warmup == nil {
+		return nil
+	}
+	status := *i.warmup
+	return &status
+}
+
+// warmupOrder returns the IDs of all manifests followed by all other documents, most recently updated first
+func (i *Index) warmupOrder() []string {
+	var manifests, docs []Document
+	i.docs.DoWithMap(func(m map[string]Document) {
+		manifests = make([]Document, 0)
+		docs = make([]Document, 0, len(m))
+		for _, d := range m {
+			if d.IsManifest() {
+				manifests = append(manifests, d)
+			} else {
+				docs = append(docs, d)
+			}
+		}
+	})
+
+	sort.Slice(docs, func(a, b int) bool {
+		return docs[a].UpdatedAt > docs[b].UpdatedAt
+	})
+
+	ids := make([]string, 0, len(manifests)+len(docs))
+	for _, d := range append(manifests, docs...) {
+		ids = append(ids, d.ID)
+	}
+	return ids
+}
+
+// startWarmup marks the index as warming up, returning nil if it has already been warmed since it was opened
+func (i *Index) startWarmup() *WarmupStatus {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	if i.warmup != nil {
+		return nil
+	}
+	i.warmup = &WarmupStatus{State: WarmupRunning, StartedAt: time.Now()}
+	status := *i.warmup
+	return &status
+}
+
+func (i *Index) setWarmup(status WarmupStatus) {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	i.warmup = &status
+}
+
+func (i *Index) isClosing() bool {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	return i.closed
+}
+
+// warmIndexes warms up queued indexes one at a time until the manager is closed
+func (m *IndexManager) warmIndexes() {
+	for {
+		select {
+		case <-m.done:
+			return
+		case i := <-m.warmQueue:
+			if err := i.Warm(m.done); err != nil {
+				m.config.logf("Error warming up index %v: %v\n", i.ID, err)
+			}
+		}
+	}
+}
+
+// queueWarmup adds an index to the warm-up queue, skipping it if the queue is full
+func (m *IndexManager) queueWarmup(i *Index) {
+	select {
+	case m.warmQueue <- i:
+	default:
+		m.config.logf("Warm-up queue is full, skipping index %v\n", i.ID)
+	}
+}
+
+// warmRecentIndexes queues the indexes with the most recently modified files for warm-up, up to the open index limit
+func (m *IndexManager) warmRecentIndexes(files []os.FileInfo) {
+	sort.Slice(files, func(a, b int) bool {
+		return files[a].ModTime().After(files[b].ModTime())
+	})
+
+	if m.maxOpenIndexes > 0 && len(files) > m.maxOpenIndexes {
+		files = files[:m.maxOpenIndexes]
+	}
+
+	for _, file := range files {
+		i := m.GetIndex(indexIDFromFilename(file.Name()))
+		if i == nil {
+			continue
+		}
+		select {
+		case <-m.done:
+			return
+		case m.warmQueue <- i:
+		}
+	}
+}